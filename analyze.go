@@ -0,0 +1,452 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Analyze compiles the given module, and reports the critical path of each
+// of its functions, how many calls it could make at once, and which variables
+// make its calls wait for each other.
+func Analyze(main string, resolver Resolver) (string, error) {
+	program, err := loadProgram(main, resolver)
+	if err != nil {
+		return "", err
+	}
+
+	a := &analyzer{
+		Functions: map[string]*generator{},
+		Results:   map[string]*analysis{},
+	}
+	names := []string{}
+	for _, gen := range program.GeneratedFunctions {
+		a.Functions[gen.Name] = gen
+		if !gen.IsNative {
+			names = append(names, gen.Name)
+		}
+	}
+	sort.Strings(names)
+
+	result := strings.Builder{}
+	for i, name := range names {
+		if i > 0 {
+			fmt.Fprintf(&result, "\n")
+		}
+		a.Analyze(name).FormatInto(&result)
+	}
+	return result.String(), nil
+}
+
+// analysis is what's known about how long a function takes to run. Times are
+// in seconds of the program's clock, which only sleeps move on.
+type analysis struct {
+	Name string
+
+	// Path lists the calls on the critical path, with how long each of them
+	// takes, and Time is how long they take altogether.
+	Path  []string
+	Time  float64
+	Width int
+
+	// Unknown is set if some calls take an unknown amount of time, such as
+	// loops, function values and I/O, so that Time is only a lower bound.
+	Unknown bool
+
+	// Serialized lists the variables that the critical path passes from
+	// call to call, and how many calls each of them links together.
+	Serialized []serializedVariable
+}
+
+type serializedVariable struct {
+	Name  string
+	Kind  *Kind
+	Calls int
+
+	// Waits counts the calls that take time, rather than finishing at once.
+	Waits int
+}
+
+type analyzer struct {
+	Functions map[string]*generator
+	Results   map[string]*analysis
+}
+
+// step is the earliest that a statement can finish, following the statement
+// it waits for last.
+type step struct {
+	Time    float64
+	Calls   int
+	Level   int
+	Unknown bool
+	Prev    int
+}
+
+// later orders steps by time, and then by the number of calls before them.
+func (s step) later(t step) bool {
+	if s.Time != t.Time {
+		return s.Time > t.Time
+	}
+	return s.Calls > t.Calls
+}
+
+func isCall(stmt generatedStatement) bool {
+	switch stmt.(type) {
+	case *genCallSyncFunction, *genCallAsyncFunction, *genCallFunctionValue:
+		return true
+	}
+	return false
+}
+
+// Analyze finds the critical path of the named function, assuming that
+// statements run as soon as everything they need is ready.
+func (a *analyzer) Analyze(name string) *analysis {
+	if result, ok := a.Results[name]; ok {
+		return result
+	}
+
+	// Recursive calls are assumed to take an unknown amount of time, until
+	// the analysis is finished.
+	result := &analysis{Name: name, Unknown: true}
+	a.Results[name] = result
+
+	g := a.Functions[name]
+	preds, names := dependencies(g)
+
+	// Visiting each statement after everything that it waits for finds
+	// when each of them can finish in a single pass.
+	steps := make([]step, len(g.Conditions))
+	for _, i := range topologicalOrder(preds) {
+		stmt := g.Conditions[i]
+		// first() finishes as soon as either of its inputs does, and
+		// everything else once all of them have.
+		call, ok := stmt.Statement.(*genCallAsyncFunction)
+		first := ok && call.Name == "first"
+
+		current := step{Prev: -1}
+		level := 0
+		for j, edge := range preds[i] {
+			before := step{Prev: edge.From}
+			if edge.From >= 0 {
+				before = steps[edge.From]
+				before.Prev = edge.From
+				before.Level = steps[edge.From].Level
+				if isCall(g.Conditions[edge.From].Statement) {
+					before.Level++
+				}
+			}
+			if before.Level > level {
+				level = before.Level
+			}
+			if j == 0 || before.later(current) != first {
+				current = before
+			}
+		}
+		current.Level = level
+
+		cost, known := a.cost(g, stmt.Statement)
+		current.Time += cost
+		current.Unknown = current.Unknown || !known
+		if isCall(stmt.Statement) {
+			current.Calls++
+		}
+		steps[i] = current
+	}
+
+	// The function finishes once it returns, even if calls that it
+	// cancelled would have taken longer.
+	result.Unknown = false
+	last := -1
+	for i, stmt := range g.Conditions {
+		switch stmt.Statement.(type) {
+		case *genReturn, *genRestartLoop:
+			result.Unknown = result.Unknown || steps[i].Unknown
+			if last < 0 || steps[i].later(steps[last]) {
+				last = i
+			}
+		}
+	}
+
+	// Walk back along the critical path, counting the calls that each
+	// variable carries it between.
+	links := map[register]map[int]bool{}
+	for i := last; i >= 0; i = steps[i].Prev {
+		stmt := g.Conditions[i].Statement
+		if isCall(stmt) {
+			label := describeStatement(stmt)
+			if cost, known := a.cost(g, stmt); !known {
+				label += " (unknown)"
+			} else if cost > 0 {
+				label += fmt.Sprintf(" (%.1fs)", cost)
+			}
+			result.Path = append([]string{label}, result.Path...)
+		}
+
+		prev := steps[i].Prev
+		if prev < 0 {
+			continue
+		}
+		for _, edge := range preds[i] {
+			if edge.From != prev || edge.Register < 0 {
+				continue
+			}
+			if _, ok := names[edge.Register]; !ok {
+				continue
+			}
+			if links[edge.Register] == nil {
+				links[edge.Register] = map[int]bool{}
+			}
+			for _, end := range []int{edge.From, edge.To} {
+				if end >= 0 && isCall(g.Conditions[end].Statement) {
+					links[edge.Register][end] = true
+				}
+			}
+		}
+	}
+	if last >= 0 {
+		result.Time = steps[last].Time
+	}
+
+	// A variable is held in a new register each time a call hands it back.
+	calls := map[string]map[int]bool{}
+	kinds := map[string]*Kind{}
+	for reg, ends := range links {
+		name := names[reg].Name
+		if calls[name] == nil {
+			calls[name] = map[int]bool{}
+		}
+		if kinds[name] == nil {
+			kinds[name] = names[reg].Kind
+		}
+		for end := range ends {
+			calls[name][end] = true
+		}
+	}
+	for name, ends := range calls {
+		if len(ends) < 2 {
+			continue
+		}
+		waits := 0
+		for end := range ends {
+			if cost, known := a.cost(g, g.Conditions[end].Statement); cost > 0 || !known {
+				waits++
+			}
+		}
+		result.Serialized = append(result.Serialized, serializedVariable{name, kinds[name], len(ends), waits})
+	}
+	sort.Slice(result.Serialized, func(i, j int) bool {
+		if result.Serialized[i].Calls != result.Serialized[j].Calls {
+			return result.Serialized[i].Calls > result.Serialized[j].Calls
+		}
+		return result.Serialized[i].Name < result.Serialized[j].Name
+	})
+
+	// Calls at the same level could all run at once, but only one side of
+	// each branch runs.
+	perLevel := map[int]map[condition]int{}
+	for i, stmt := range g.Conditions {
+		if !isCall(stmt.Statement) {
+			continue
+		}
+		if perLevel[steps[i].Level] == nil {
+			perLevel[steps[i].Level] = map[condition]int{}
+		}
+		perLevel[steps[i].Level][stmt.Cond]++
+	}
+	for _, counts := range perLevel {
+		widest := 0
+		for cond, count := range counts {
+			if cond != 0 && count > widest {
+				widest = count
+			}
+		}
+		if width := counts[0] + widest; width > result.Width {
+			result.Width = width
+		}
+	}
+
+	return result
+}
+
+// dependencies lists the edges leading to each statement of the function,
+// from the statements that provide its registers and from the branch that
+// decides whether it runs.
+func dependencies(g *generator) ([][]dataflowEdge, map[register]variable) {
+	exclusive := exclusiveConditions(g)
+	edges, names := g.Dataflow()
+	preds := make([][]dataflowEdge, len(g.Conditions))
+	for _, edge := range edges {
+		// Both sides of a branch may provide a register that is read after
+		// it, but neither side provides it to the other.
+		if edge.From >= 0 && exclusive(g.Conditions[edge.From].Cond, g.Conditions[edge.To].Cond) {
+			continue
+		}
+		preds[edge.To] = append(preds[edge.To], edge)
+	}
+
+	// Statements that only run on one side of a branch wait for it too.
+	for i, stmt := range g.Conditions {
+		if stmt, ok := stmt.Statement.(statementWithBranches); ok {
+			for cond := range stmt.Branches() {
+				for j, other := range g.Conditions {
+					if other.Cond == cond {
+						preds[j] = append(preds[j], dataflowEdge{i, j, -1})
+					}
+				}
+			}
+		}
+	}
+	return preds, names
+}
+
+// exclusiveConditions returns whether two conditions can never both hold,
+// since they're on opposite sides of the same branch.
+func exclusiveConditions(g *generator) func(a, b condition) bool {
+	parent := map[condition]condition{}
+	opposite := map[condition]condition{}
+	for _, stmt := range g.Conditions {
+		if branch, ok := stmt.Statement.(*genBranch); ok {
+			parent[branch.IfTrue], parent[branch.IfFalse] = stmt.Cond, stmt.Cond
+			opposite[branch.IfTrue], opposite[branch.IfFalse] = branch.IfFalse, branch.IfTrue
+		}
+	}
+	return func(a, b condition) bool {
+		within := map[condition]bool{}
+		for ; b != 0; b = parent[b] {
+			within[b] = true
+		}
+		for ; a != 0; a = parent[a] {
+			if other, ok := opposite[a]; ok && within[other] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// topologicalOrder orders statements so that each one comes after everything
+// it waits for, keeping the order they were generated in where it can. Dataflow
+// doesn't always follow that order, since registers are joined where branches
+// merge. Statements that wait on each other, and so never run, come last.
+func topologicalOrder(preds [][]dataflowEdge) []int {
+	waiting := make([]int, len(preds))
+	succs := make([][]int, len(preds))
+	for i, edges := range preds {
+		for _, edge := range edges {
+			if edge.From >= 0 {
+				waiting[i]++
+				succs[edge.From] = append(succs[edge.From], i)
+			}
+		}
+	}
+
+	order := make([]int, 0, len(preds))
+	placed := make([]bool, len(preds))
+	for len(order) < len(preds) {
+		next := -1
+		for i := range preds {
+			if !placed[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			for i := range preds {
+				if !placed[i] {
+					order = append(order, i)
+				}
+			}
+			break
+		}
+
+		placed[next] = true
+		order = append(order, next)
+		for _, succ := range succs[next] {
+			waiting[succ]--
+		}
+	}
+	return order
+}
+
+// cost is how long a statement takes on the program's clock, and whether
+// that's known before running it. Only sleeps for a constant duration, and
+// calls to functions that only make them, take a known, nonzero time.
+func (a *analyzer) cost(g *generator, stmt generatedStatement) (float64, bool) {
+	switch s := stmt.(type) {
+	case *genCallAsyncFunction:
+		callee, ok := a.Functions[s.Name]
+		if !ok {
+			return 0, false
+		} else if !callee.IsNative {
+			callee := a.Analyze(s.Name)
+			return callee.Time, !callee.Unknown
+		}
+		switch s.Name {
+		case "sleep":
+			duration := g.ResolveRegister(s.Args[1])
+			for _, other := range g.Conditions {
+				if literal, ok := other.Statement.(*genIntegerLiteral); ok && g.ResolveRegister(literal.Target) == duration {
+					return float64(literal.Value), true
+				}
+			}
+			return 0, false
+		case "first":
+			return 0, true
+		}
+		return 0, false
+	case *genCallFunctionValue, *genRestartLoop:
+		return 0, false
+	}
+	return 0, true
+}
+
+// FormatInto writes the analysis for people to read.
+func (r *analysis) FormatInto(w io.Writer) {
+	atLeast := ""
+	if r.Unknown {
+		atLeast = "at least "
+	}
+	fmt.Fprintf(w, "func %s\n", r.Name)
+	fmt.Fprintf(w, "  critical path: %s%.1fs, %s\n", atLeast, r.Time, plural(len(r.Path), "call"))
+	for _, call := range r.Path {
+		fmt.Fprintf(w, "    %s\n", call)
+	}
+	fmt.Fprintf(w, "  parallel width: %s\n", plural(r.Width, "call"))
+	if len(r.Serialized) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  serialized by:\n")
+	for _, v := range r.Serialized {
+		fmt.Fprintf(w, "    %s", v.Name)
+		if v.Kind != nil {
+			fmt.Fprintf(w, " (%s)", v.Kind)
+		}
+		fmt.Fprintf(w, ", through %d calls", v.Calls)
+		if v.Kind != nil && v.Kind.Family == FamilyClock && v.Waits > 1 {
+			fmt.Fprintf(w, "; fork it to let them overlap, and join the copies afterwards")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
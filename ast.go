@@ -15,8 +15,9 @@
 package unique_effect
 
 import (
-	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 type register int
@@ -26,16 +27,26 @@ type childCall int
 func (a *astConditionalStmt) Captures(out map[string]bool) {
 	a.Cond.Captures(out)
 	a.IfTrue.Captures(out)
-	a.Otherwise.Captures(out)
+	if a.ElseIf != nil {
+		a.ElseIf.Captures(out)
+	} else if a.Otherwise != nil {
+		a.Otherwise.Captures(out)
+	}
 }
 
 func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 	cond, err := a.Cond.Generate(p, b)
-	if err != nil {
-		return err
+	if err == nil && len(cond) != 1 {
+		err = newError(CodeArity, "Got multiple values in condition").At(a.Cond.Span())
 	}
-	if len(cond) != 1 {
-		return errors.New("Got multiple values in condition")
+	if err != nil {
+		if a.TypeAssertKind != nil {
+			return err
+		}
+
+		// Keep checking both branches, as though the condition were valid.
+		b.Report(a.Cond.Span(), err)
+		cond = []register{b.NewReg(p.MustResolveBuiltinType("Boolean"), true)}
 	}
 	condition := cond[0]
 
@@ -45,19 +56,20 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 
 	if a.TypeAssertKind != nil {
 		// Allow type assertions to narrow the type of a union
-		if a.Cond.Comparison == nil && len(a.Cond.Sum.Terms) == 0 && len(a.Cond.Sum.Call.Calls) == 0 && a.Cond.Sum.Call.Base.Variable != nil {
-			typeAssertVarName = *a.Cond.Sum.Call.Base.Variable
+		if name, ok := a.Cond.AsVariable(); ok {
+			typeAssertVarName = name
 			unionRegister = b.Locals[typeAssertVarName]
 			unionKind = b.Registers[unionRegister]
 		}
 
 		union := b.Registers[condition]
 		if union.Family != FamilyUnion {
-			return errors.New("Attempted to do a type switch on a non-union")
+			return newError(CodeBadTypeSwitch, "Attempted to do a type switch on a non-union").At(a.Cond.Span()).
+				WithNote("the value has type %s", union)
 		}
 		unionArgs := union.UnpackAsUnion()
 
-		resolved, err := p.ResolveType(a.TypeAssertKind)
+		resolved, err := p.resolveType(a.TypeAssertKind, b.TypeArgs)
 		if err != nil {
 			return err
 		}
@@ -71,7 +83,9 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 		}
 
 		if found < 0 {
-			return errors.New("Attempted to type switch on impossible type")
+			return newError(CodeBadTypeSwitch, "Attempted to type switch on impossible type").
+				At(a.TypeAssertKind.Span()).
+				WithNote("the value has type %s", union)
 		}
 
 		result := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
@@ -87,9 +101,11 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 	}
 
 	if !b.Registers[condition].IsBooleanLike() {
-		return fmt.Errorf("expecting boolean argument")
+		return newError(CodeExpectedBoolean, "expecting boolean argument").At(a.Cond.Span()).
+			WithNote("the condition has type %s", b.Registers[condition])
 	}
 
+	b.ReassembleAll()
 	parentCondition := b.CurrentCondition
 	trueCondition := b.NewCondition()
 	falseCondition := b.NewCondition()
@@ -103,7 +119,7 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 	b.CurrentCondition = trueCondition
 
 	if typeAssertVarName != "" {
-		resolved, err := p.ResolveType(a.TypeAssertKind)
+		resolved, err := p.resolveType(a.TypeAssertKind, b.TypeArgs)
 		if err != nil {
 			return err
 		}
@@ -113,20 +129,18 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 		b.Locals[typeAssertVarName] = overwrittenReg
 	}
 
-	if err := a.IfTrue.Generate(p, b); err != nil {
-		return err
-	}
+	a.IfTrue.Generate(p, b)
+	b.ReassembleAll()
 
-	localsAfterTrue := b.Locals
+	ifTrue := b.EndBranch(trueCondition, len(registers))
 	b.Locals = localsBeforeTrue
 	copy(b.Registers[:len(registers)], registers)
-	localsBeforeFalse := b.CopyOfLocals()
 
 	b.CurrentCondition = falseCondition
 
 	// If the union is composed of exactly two values, use the remaining one.
 	if typeAssertVarName != "" && len(unionKind.UnpackAsUnion()) == 2 {
-		resolved, err := p.ResolveType(a.TypeAssertKind)
+		resolved, err := p.resolveType(a.TypeAssertKind, b.TypeArgs)
 		if err != nil {
 			return err
 		}
@@ -142,60 +156,170 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 		b.Locals[typeAssertVarName] = overwrittenReg
 	}
 
-	if err := a.Otherwise.Generate(p, b); err != nil {
-		return err
+	// A missing else branch leaves every variable as it was.
+	if a.ElseIf != nil {
+		if err := a.ElseIf.Generate(p, b); err != nil {
+			b.Report(a.ElseIf.Cond.Span(), err)
+		}
+	} else if a.Otherwise != nil {
+		a.Otherwise.Generate(p, b)
 	}
+	b.ReassembleAll()
 
 	b.CurrentCondition = parentCondition
 
-	localsAfterFalse := b.Locals
-	b.Locals = localsBeforeFalse
+	ifFalse := b.EndBranch(falseCondition, len(ifTrue.Registers))
 
-	for name := range b.Locals {
-		regTrue, ok := localsAfterTrue[name]
-		if !ok {
-			delete(b.Locals, name)
-			continue
-		}
+	// If only one branch carries on, a variable narrowed by "is" stays
+	// narrowed to whatever that branch made of it.
+	if typeAssertVarName != "" && ifTrue.Terminated != ifFalse.Terminated {
+		localsAtStart[typeAssertVarName] = unionRegister
+	}
 
-		regFalse, ok := localsAfterFalse[name]
-		if !ok {
-			delete(b.Locals, name)
-			continue
-		}
+	if err := b.MergeBranches("if-statement", localsAtStart, ifTrue, ifFalse); err != nil {
+		return err.At(a.Cond.Span())
+	}
+
+	return nil
+}
+
+func (a *astMatchStmt) Captures(out map[string]bool) {
+	out[a.Subject.Name] = true
+	for _, arm := range a.Arms {
+		arm.Block.Captures(out)
+	}
+}
+
+// A matchArm is an arm of a match statement, along with which member of the
+// union it handles.
+type matchArm struct {
+	*astMatchArm
+	Index int
+	Kind  *Kind
+}
+
+func (a *astMatchStmt) Generate(p *program, b *generator) error {
+	union, err := b.Lookup(a.Subject.Name, a.Subject.Span())
+	if err != nil {
+		return err
+	}
+
+	unionKind := b.Registers[union]
+	if unionKind.Family != FamilyUnion {
+		return newError(CodeBadTypeSwitch, "Attempted to match on a non-union").At(a.Subject.Span()).
+			WithNote("%s has type %s", a.Subject.Name, unionKind)
+	}
+	if unionKind.Borrowed {
+		return newError(CodeBadBorrow, "cannot match on borrowed union %s", a.Subject.Name).At(a.Subject.Span())
+	}
+	members := unionKind.UnpackAsUnion()
 
-		if err := b.Registers[regTrue].IsEquivalent(*b.Registers[regFalse]); err != nil {
-			return fmt.Errorf("%s has unequal types on both sides of if-statement: %w", err)
+	arms := []matchArm{}
+	covered := map[int]*astMatchArm{}
+	for _, arm := range a.Arms {
+		resolved, err := p.resolveType(arm.Kind, b.TypeArgs)
+		if err != nil {
+			return err
 		}
 
-		// If the variable is used on one side and not the other, make sure
-		// that both sides have a unique variable name, so that any future
-		// dependencies on this variable wait until the condition is resolved.
-		if regTrue != regFalse {
-			if regTrue == localsAtStart[name] {
-				renamed := b.NewReg(b.Registers[regTrue], true)
-				b.Conditions = append(b.Conditions, stmtWithCondition{trueCondition, &genRenameRegister{regTrue, renamed}})
-				regTrue = renamed
+		found := -1
+		for i, member := range members {
+			if member.IsEquivalent(*resolved) == nil {
+				found = i
+				break
 			}
+		}
+		if found < 0 {
+			return newError(CodeBadTypeSwitch, "%s is never a %s", a.Subject.Name, resolved).At(arm.Kind.Span()).
+				WithNote("%s has type %s", a.Subject.Name, unionKind)
+		}
+		if previous, ok := covered[found]; ok {
+			return newError(CodeDuplicateArm, "%s is matched more than once", resolved).At(arm.Kind.Span()).
+				WithRelated(previous.Kind.Span(), "first matched here")
+		}
+		covered[found] = arm
+		arms = append(arms, matchArm{arm, found, resolved})
+	}
 
-			if regFalse == localsAtStart[name] {
-				renamed := b.NewReg(b.Registers[regFalse], true)
-				b.Conditions = append(b.Conditions, stmtWithCondition{falseCondition, &genRenameRegister{regFalse, renamed}})
-				regFalse = renamed
-			}
+	missing := []string{}
+	for i, member := range members {
+		if covered[i] == nil {
+			missing = append(missing, member.String())
 		}
+	}
+	if len(missing) > 0 {
+		return newError(CodeNonExhaustive, "match on %s doesn't handle %s", a.Subject.Name, strings.Join(missing, ", ")).
+			At(a.Subject.Span()).
+			WithNote("%s has type %s; add an arm for each of its members", a.Subject.Name, unionKind)
+	}
+
+	// The union is taken apart by whichever arm runs, and each arm sees the
+	// member under the union's name.
+	b.Forget(b.ResolveRegister(union))
+	delete(b.Locals, a.Subject.Name)
+
+	return a.generateArms(p, b, union, arms)
+}
+
+// generateArms generates the first arm of a match, and then the rest of them
+// under the condition that the union isn't the first arm's member.
+func (a *astMatchStmt) generateArms(p *program, b *generator, union register, arms []matchArm) error {
+	arm := arms[0]
+	if len(arms) == 1 {
+		value := b.NewReg(arm.Kind, true)
+		b.Stmt(&genExtractUnionValue{union, value})
+		b.Locals[a.Subject.Name] = value
+		arm.Block.Generate(p, b)
+		b.ReassembleAll()
+		return nil
+	}
+
+	matches := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+	b.Stmt(&genCheckUnionType{union, arm.Index, matches})
+
+	b.ReassembleAll()
+	parentCondition := b.CurrentCondition
+	trueCondition := b.NewCondition()
+	falseCondition := b.NewCondition()
+	registers := make([]*Kind, len(b.Registers))
+	copy(registers, b.Registers)
+
+	b.Stmt(&genBranch{matches, trueCondition, falseCondition})
+
+	localsAtStart := b.CopyOfLocals()
+	b.CurrentCondition = trueCondition
+	value := b.NewReg(arm.Kind, true)
+	b.Stmt(&genExtractUnionValue{union, value})
+	b.Locals[a.Subject.Name] = value
+	arm.Block.Generate(p, b)
+	b.ReassembleAll()
+	ifTrue := b.EndBranch(trueCondition, len(registers))
+
+	b.Locals = map[string]register{}
+	for name, reg := range localsAtStart {
+		b.Locals[name] = reg
+	}
+	copy(b.Registers[:len(registers)], registers)
 
-		b.JoinRegisters(regTrue, regFalse)
-		b.Locals[name] = regTrue
+	b.CurrentCondition = falseCondition
+	if err := a.generateArms(p, b, union, arms[1:]); err != nil {
+		return err
 	}
+	ifFalse := b.EndBranch(falseCondition, len(ifTrue.Registers))
 
+	b.CurrentCondition = parentCondition
+	if err := b.MergeBranches("match", localsAtStart, ifTrue, ifFalse); err != nil {
+		return err.At(a.Subject.Span())
+	}
 	return nil
 }
 
 func (a *astExpressionBase) Captures(out map[string]bool) {
-	if a.StructArguments != nil {
+	if a.Lambda != nil {
+		a.Lambda.Captures(out)
+	} else if a.StructArguments != nil {
 		for _, arg := range a.StructArguments {
-			arg.Captures(out)
+			arg.Value.Captures(out)
 		}
 	} else if a.Variable != nil {
 		if *a.Variable != "true" && *a.Variable != "false" {
@@ -213,29 +337,67 @@ func (a *astExpressionBase) Captures(out map[string]bool) {
 }
 
 func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, error) {
-	if a.StructArguments != nil {
-		kind, err := p.ResolveType(&TypeRep{false, *a.Variable, nil})
+	if a.Lambda != nil {
+		reg, err := a.Lambda.Generate(p, b)
 		if err != nil {
 			return nil, err
 		}
-		fields := []register{}
-		expectedKinds := kind.UnpackAsTuple()
-		for i, ast := range a.StructArguments {
+		return []register{reg}, nil
+
+	} else if a.StructArguments != nil {
+		rep := &TypeRep{Name: *a.Variable, Pos: a.Pos, EndPos: a.Pos}
+		strct, ok := p.Types[*a.Variable]
+		if !ok {
+			_, err := p.ResolveType(rep)
+			return nil, err
+		}
+		args, err := orderStructArgs(strct, a.StructArguments, a.Span())
+		if err != nil {
+			return nil, err
+		}
+
+		values := []register{}
+		for _, ast := range args {
 			regs, err := ast.Generate(p, b)
 			if err != nil {
 				return nil, err
 			}
 			if len(regs) != 1 {
-				return nil, errors.New("Cannot use multi-variable value in tuple")
+				return nil, newError(CodeArity, "Cannot use multi-variable value in tuple").At(ast.Span())
 			}
-			if err := b.Registers[regs[0]].CanConvertTo(*expectedKinds[i]); err != nil {
-				return nil, err
+			values = append(values, regs[0])
+		}
+
+		// The type arguments of a generic struct are inferred from its fields.
+		bindings := map[string]*Kind{}
+		for i, field := range strct.Fields {
+			if err := unify(field.Kind, b.Registers[values[i]], strct.TypeParams, bindings); err != nil {
+				return nil, asDiagnostic(CodeTypeMismatch, err).At(args[i].Span())
+			}
+		}
+		for _, param := range strct.TypeParams {
+			if _, ok := bindings[param]; !ok {
+				return nil, newError(CodeTypeMismatch, "cannot infer type parameter %s of %s", param, strct.Name).At(a.Span())
+			}
+			rep.Args = append(rep.Args, &TypeRep{Name: param})
+		}
+		kind, err := p.resolveType(rep, bindings)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := []register{}
+		expectedKinds := kind.UnpackAsTuple()
+		for i, ast := range args {
+			field, err := convertTo(b, values[i], expectedKinds[i], ast.Span())
+			if err != nil {
+				return nil, asDiagnostic(CodeTypeMismatch, err).At(ast.Span())
 			}
-			fields = append(fields, regs[0])
-			b.Consume(regs[0], &a.Pos)
+			fields = append(fields, field)
+			b.Consume(field, ast.Span())
 		}
 
-		result := b.NewReg(&Kind{false, FamilyTuple, expectedKinds, *a.Variable}, true)
+		result := b.NewReg(kind, true)
 		b.Stmt(&genMakeTuple{Inputs: fields, Result: result})
 		return []register{result}, nil
 
@@ -250,13 +412,19 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 			return []register{reg}, nil
 		}
 
-		if v, ok := b.Locals[*a.Variable]; ok {
-			return []register{v}, nil
+		if fun, ok := p.Functions[*a.Variable]; ok && !b.IsLocal(*a.Variable) {
+			reg, err := fun.Value(p, b, a.Span())
+			if err != nil {
+				return nil, err
+			}
+			return []register{reg}, nil
 		}
-		if pos, ok := b.ConsumedLocals[*a.Variable]; ok {
-			return nil, fmt.Errorf("attempted to read consumed variable \"%s\" (was consumed at %s)", *a.Variable, pos)
+
+		reg, err := b.Lookup(*a.Variable, a.Span())
+		if err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("unknown variable \"%s\"", *a.Variable)
+		return []register{reg}, nil
 
 	} else if a.String != nil {
 		reg := b.NewReg(p.MustResolveBuiltinType("String"), true)
@@ -276,7 +444,7 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 				return nil, err
 			}
 			if len(regs) != 1 {
-				return nil, errors.New("Cannot use multi-variable value in tuple")
+				return nil, newError(CodeArity, "Cannot use multi-variable value in tuple").At(ast.Span())
 			}
 			result = append(result, regs[0])
 		}
@@ -291,38 +459,56 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 				return nil, err
 			}
 			if len(regs) != 1 {
-				return nil, errors.New("Cannot use multi-variable value in array")
+				return nil, newError(CodeArity, "Cannot use multi-variable value in array").At(ast.Span())
 			}
 			mykind := b.Registers[regs[0]]
 			if kind == nil {
 				kind = mykind
 			} else if err := kind.IsEquivalent(*mykind); err != nil {
-				return nil, err
+				return nil, newError(CodeTypeMismatch, "array elements have different types: %s", err).At(ast.Span())
 			}
 			result = append(result, regs[0])
+
+			// Elements are moved into the array.
+			if !mykind.IsPrimitive() {
+				b.Consume(b.ResolveRegister(regs[0]), ast.Span())
+			}
 		}
-		reg := b.NewReg(&Kind{false, FamilyArray, []*Kind{kind}, "Array"}, true)
+		reg := b.NewReg(&Kind{false, FamilyArray, []*Kind{kind}, "Array", nil, nil}, true)
 		b.Stmt(&genNewArray{reg, result})
 		return []register{reg}, nil
 
 	} else {
-		return nil, fmt.Errorf("Unknown astExpressionBase %v", a)
+		return nil, newError(CodeUnsupported, "Unknown astExpressionBase %v", a).At(a.Span())
 	}
 }
 
 func (a *astMethodArg) Captures(out map[string]bool) {
 	if a.Borrow != nil {
-		out[*a.Borrow] = true
+		out[strings.Split(*a.Borrow, ".")[0]] = true
 	} else {
 		a.Expr.Captures(out)
 	}
 }
 
 func (a *astMethodArg) Generate(p *program, b *generator) (reg register, borrow string, err error) {
+	if a.Borrow != nil {
+		// Borrowing a field, or a struct whose fields have been borrowed,
+		// goes through the struct's fields.
+		path := strings.Split(*a.Borrow, ".")
+		if _, exploded := b.Exploded[path[0]]; len(path) > 1 || exploded {
+			return accessField(p, b, path[0], path[1:], a.Span(), true)
+		}
+	}
+
 	if a.Borrow != nil {
 		var ok bool
 		if reg, ok = b.Locals[*a.Borrow]; !ok {
-			err = fmt.Errorf("Cannot borrow non-existing local variable %s", *a.Borrow)
+			diag := newError(CodeBadBorrow, "Cannot borrow non-existing local variable %s", *a.Borrow).At(a.Span())
+			if span, ok := b.ConsumedLocals[*a.Borrow]; ok {
+				diag.WithRelated(span, "\"%s\" was consumed here", *a.Borrow)
+			}
+			err = diag
 			return
 		}
 		borrow = *a.Borrow
@@ -332,7 +518,7 @@ func (a *astMethodArg) Generate(p *program, b *generator) (reg register, borrow
 			return
 		}
 		if len(regs) != 1 {
-			err = fmt.Errorf("multi argument value passed as function arg")
+			err = newError(CodeArity, "multi argument value passed as function arg").At(a.Span())
 			return
 		}
 		reg = regs[0]
@@ -340,228 +526,1263 @@ func (a *astMethodArg) Generate(p *program, b *generator) (reg register, borrow
 	return
 }
 
-func buildMethodCall(p *program, b *generator, calleeName string, args []*astMethodArg) ([]register, error) {
-	callee, ok := p.Functions[calleeName]
-	if !ok {
-		return []register{}, fmt.Errorf("no function %s", calleeName)
-	}
-
-	kinds := []*Kind{}
-	registers := []register{}
-	borrows := []string{}
+// callArgs are the arguments generated for a call. Borrows names the
+// variables passed with &, which are given back as the leading results of
+// the call.
+type callArgs struct {
+	Registers []register
+	Kinds     []*Kind
+	Borrows   []string
+}
 
+// generate generates the arguments of a call, consuming any that are passed
+// to a parameter that isn't borrowed.
+func (c *callArgs) generate(p *program, b *generator, args []*astMethodArg, borrowed func(int) bool) error {
 	for i, arg := range args {
 		reg, borrow, err := arg.Generate(p, b)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		registers = append(registers, reg)
-		kinds = append(kinds, b.Registers[reg])
-		borrows = append(borrows, borrow)
+		c.Registers = append(c.Registers, reg)
+		c.Kinds = append(c.Kinds, b.Registers[reg])
+		c.Borrows = append(c.Borrows, borrow)
 
 		// Clear out all registers/local variables that were moved into this
-		// function.
-		if !callee.Args[i].Kind.Borrowed {
-			b.Consume(reg, &arg.Pos)
+		// function. Primitives are copied instead.
+		if !borrowed(i) && (b.Registers[reg] == nil || !b.Registers[reg].IsPrimitive()) {
+			b.Consume(reg, arg.Span())
 		}
 	}
+	return nil
+}
 
-	resultKinds, err := callee.ReturnValue(p, kinds)
-	if err != nil {
-		return []register{}, err
-	}
-
-	for len(borrows) < len(resultKinds) {
-		borrows = append(borrows, "")
-	}
-
-	results := []register{}
-	for _, kind := range resultKinds {
-		results = append(results, b.NewReg(kind, callee.IsSynchronous))
-	}
-
-	if callee.IsSynchronous {
-		b.Stmt(&genCallSyncFunction{calleeName, registers, results})
-	} else {
-		b.Stmt(&genCallAsyncFunction{calleeName, registers, results, b.NewChildCall(calleeName)})
+// restore gives back the variables passed with &, if the call doesn't
+// compile, so that later statements don't report them as consumed.
+func (c *callArgs) restore(b *generator) {
+	for i, borrow := range c.Borrows {
+		if borrow != "" {
+			delete(b.ConsumedLocals, borrow)
+			b.Locals[borrow] = c.Registers[i]
+			b.Registers[c.Registers[i]] = c.Kinds[i]
+		}
 	}
+}
 
+// bind assigns the leading results of the call to the variables passed with
+// &, and returns the rest.
+func (c *callArgs) bind(b *generator, results []register) []register {
 	actualResults := []register{}
 	for i, result := range results {
-		if borrows[i] != "" {
-			b.Locals[borrows[i]] = result
+		if i < len(c.Borrows) && c.Borrows[i] != "" {
+			b.Locals[c.Borrows[i]] = result
 		} else {
 			actualResults = append(actualResults, result)
 		}
 	}
-
-	return actualResults, nil
+	return actualResults
 }
 
-func (a *astExpression) Captures(out map[string]bool) {
-	a.Sum.Captures(out)
-	if a.Comparison != nil {
-		a.Comparison.Operand.Captures(out)
+func buildMethodCall(p *program, b *generator, calleeName string, calleeSpan Span, args []*astMethodArg) (_ []register, err error) {
+	callee, ok := p.Functions[calleeName]
+	if !ok {
+		return []register{}, newError(CodeUnknownFunction, "no function %s", calleeName).At(calleeSpan)
 	}
-}
 
-func (a *astExpression) Generate(p *program, b *generator) ([]register, error) {
-	if a.Comparison == nil {
-		return a.Sum.Generate(p, b)
-	}
+	call := &callArgs{}
+	defer func() {
+		if err != nil {
+			call.restore(b)
+		}
+	}()
 
-	lhs, err := a.Sum.Generate(p, b)
-	if err != nil {
-		return nil, err
+	borrowed := func(i int) bool {
+		return i < len(callee.Args) && callee.Args[i].Kind.Borrowed
 	}
-	if len(lhs) != 1 {
-		return nil, fmt.Errorf("expecting single valued lhs %v", lhs)
+	if err := call.generate(p, b, args, borrowed); err != nil {
+		return nil, err
 	}
-	if !b.Registers[lhs[0]].IsNumeric() {
-		return nil, fmt.Errorf("expecting number on LHS")
+	for i, reg := range call.Registers {
+		if borrowed(i) {
+			call.Registers[i] = b.Latest(reg)
+		}
 	}
 
-	rhs, err := a.Comparison.Operand.Generate(p, b)
-	if err != nil {
-		return nil, err
-	}
-	if len(rhs) != 1 {
-		return nil, fmt.Errorf("expecting single valued rhs %v", rhs)
+	results, err := emitCall(p, b, calleeName, call.Registers, call.Kinds)
+	if argErr, ok := err.(*argumentError); ok {
+		return []register{}, asDiagnostic(CodeTypeMismatch, argErr.Err).
+			At(args[argErr.Index].Span()).
+			WithRelated(callee.Args[argErr.Index].Span(), "parameter of %s", calleeName)
+	} else if err != nil {
+		diag := asDiagnostic(CodeTypeMismatch, err)
+		if diag.Span.IsZero() {
+			diag.At(calleeSpan)
+		}
+		return []register{}, diag
 	}
-	if !b.Registers[rhs[0]].IsNumeric() {
-		return nil, fmt.Errorf("expecting number on RHS")
+
+	// Asynchronous functions can read their borrowed arguments at any time
+	// until they return.
+	if !callee.IsSynchronous {
+		for i, reg := range call.Registers {
+			if borrowed(i) && call.Borrows[i] == "" && call.Kinds[i].NeedsToBeDeleted() {
+				keepAlive(b, reg, results)
+			}
+		}
 	}
 
-	result := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
-	b.Stmt(&genIntegerComparison{Operation: a.Comparison.Cond, Left: lhs[0], Right: rhs[0], Result: result})
-	return []register{result}, nil
+	return call.bind(b, results), nil
 }
 
-func (a *astExpressionSum) Captures(out map[string]bool) {
-	a.Call.Captures(out)
-	for _, term := range a.Terms {
-		term.Operand.Captures(out)
+// buildValueCall calls a function value. The function value is only
+// borrowed by the call, so that it can be called again.
+func buildValueCall(p *program, b *generator, function register, span Span, args []*astMethodArg) (_ []register, err error) {
+	kind := b.Registers[function]
+	if kind == nil || kind.Family != FamilyFunction {
+		return nil, newError(CodeTypeMismatch, "cannot call a value of type %s", kind).At(span)
 	}
-}
+	params := kind.UnpackAsTuple()
 
-func (a *astExpressionSum) Generate(p *program, b *generator) ([]register, error) {
-	call := a.Call
-	for _, term := range a.Terms {
-		c := "concat"
-		call = &astExpressionCall{
-			Base: &astExpressionBase{Variable: &c},
-			Calls: []*astMethodCall{{
-				Args: []*astMethodArg{
-					{Expr: &astExpression{Sum: &astExpressionSum{Call: call}}},
-					{Expr: &astExpression{Sum: &astExpressionSum{Call: term.Operand}}},
-				},
-			}},
+	call := &callArgs{}
+	defer func() {
+		if err != nil {
+			call.restore(b)
 		}
+	}()
+
+	borrowed := func(i int) bool {
+		return i < len(params) && params[i].Borrowed
+	}
+	if err := call.generate(p, b, args, borrowed); err != nil {
+		return nil, err
 	}
-	return call.Generate(p, b)
-}
 
-func (a *astExpressionCall) Captures(out map[string]bool) {
-	a.Base.Captures(out)
-	for _, call := range a.Calls {
-		for _, arg := range call.Args {
-			arg.Captures(out)
+	// Arguments can borrow the function value, or each other, in nested calls.
+	function = b.Latest(function)
+	for i, reg := range call.Registers {
+		if borrowed(i) {
+			call.Registers[i] = b.Latest(reg)
 		}
 	}
-}
-
-func (a *astExpressionCall) Generate(p *program, b *generator) ([]register, error) {
-	if len(a.Calls) == 0 {
-		return a.Base.Generate(p, b)
+	if b.Registers[function] == nil {
+		return nil, newError(CodeConsumedVariable, "function value was moved into its own call").At(span)
+	}
+	if len(args) != len(params) {
+		return nil, newError(CodeArity, "Type error: argument count mismatch, expecting %d, got %d", len(params), len(args)).
+			At(span).
+			WithNote("the function has type %s", kind)
+	}
+	for i, param := range params {
+		if err := call.Kinds[i].CanConvertTo(*param); err != nil {
+			return nil, asDiagnostic(CodeTypeMismatch, err).At(args[i].Span()).
+				WithNote("the function has type %s", kind)
+		}
 	}
 
-	if a.Base.Variable == nil || len(a.Calls) > 1 {
-		return []register{}, fmt.Errorf("calls of non-immediate functions are unimplemented")
+	results := []register{}
+	for _, ret := range kind.Results {
+		results = append(results, b.NewReg(ret, false))
 	}
+	b.Stmt(&genCallFunctionValue{function, call.Registers, results, b.NewChildCall("")})
 
-	return buildMethodCall(p, b, *a.Base.Variable, a.Calls[0].Args)
+	keepAlive(b, function, results)
+	for i, reg := range call.Registers {
+		if borrowed(i) && call.Borrows[i] == "" && call.Kinds[i].NeedsToBeDeleted() {
+			keepAlive(b, reg, results)
+		}
+	}
+	return call.bind(b, results), nil
 }
 
-func (a *astLetStmt) Captures(out map[string]bool) {
-	a.Value.Captures(out)
+// keepAlive moves a value that has been lent to a call into a new register,
+// once the results of the call are ready, so that it isn't deleted while the
+// callee can still read it. Variables holding the value are moved with it.
+func keepAlive(b *generator, reg register, until []register) {
+	reg = b.ResolveRegister(reg)
+	if b.Registers[reg] == nil {
+		// The same value was lent twice.
+		return
+	}
+	kept := b.NewReg(b.Registers[reg], false)
+	b.Stmt(&genKeepAlive{reg, until, kept})
+	b.KeptAlive[reg] = kept
+	for name, local := range b.Locals {
+		if b.ResolveRegister(local) == reg {
+			b.Locals[name] = kept
+		}
+	}
+	b.Forget(reg)
 }
 
-func (a *astLetStmt) Generate(p *program, b *generator) error {
-	for _, name := range a.VarNames {
-		if _, ok := b.Locals[name]; ok != a.MustExist {
-			if a.MustExist {
-				return fmt.Errorf("Variable %s does not exist", name)
-			} else {
-				return fmt.Errorf("Variable %s already exists", name)
-			}
-		}
+// emitCall calls a function with arguments that have already been generated,
+// and returns all of its results. The kinds of the arguments are passed
+// separately, since arguments that were moved into the call have already
+// been consumed.
+func emitCall(p *program, b *generator, calleeName string, registers []register, kinds []*Kind) ([]register, error) {
+	callee, ok := p.Functions[calleeName]
+	if !ok {
+		return nil, newError(CodeUnknownFunction, "no function %s", calleeName)
 	}
 
-	regs, err := a.Value.Generate(p, b)
+	name, resultKinds, err := callee.ReturnValue(p, kinds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(a.VarNames) == 1 {
-		// let a = (b, c)
-		regs = []register{b.MaybeMakeTuple(regs)}
+	// get leaves the element in the array, so it can only copy values that
+	// don't need to be deleted.
+	if callee.IsNative && callee.Name == "get" && !resultKinds[len(resultKinds)-1].IsPrimitive() {
+		return nil, newError(CodeTypeMismatch, "get can only copy Integers and Booleans out of an array, not %s", resultKinds[len(resultKinds)-1]).
+			WithNote("use take to move the element out of the array, and put to give it back")
 	}
 
-	if len(regs) == 1 && b.Registers[regs[0]].Family == FamilyTuple && len(a.VarNames) > 1 {
-		// let (b, c) = a
-		original := regs[0]
-
-		if b.Registers[original].Borrowed {
-			return fmt.Errorf("cannot unpack unowned tuple")
-		}
-
-		regs = []register{}
-		for _, kind := range b.Registers[original].UnpackAsTuple() {
-			regs = append(regs, b.NewReg(kind, true))
-		}
-		b.Stmt(&genUnpackTuple{
-			Input:   original,
-			Results: regs,
-		})
-		b.Consume(original, &a.Value.Pos)
+	results := []register{}
+	for _, kind := range resultKinds {
+		results = append(results, b.NewReg(kind, callee.IsSynchronous))
 	}
 
-	if len(regs) != len(a.VarNames) {
-		return fmt.Errorf("Arity mismatch: %d versus %d", len(regs), len(a.VarNames))
+	if callee.IsSynchronous {
+		b.Stmt(&genCallSyncFunction{name, registers, results})
+	} else {
+		b.Stmt(&genCallAsyncFunction{name, registers, results, b.NewChildCall(name)})
 	}
+	return results, nil
+}
 
-	for i, varName := range a.VarNames {
-		b.Locals[varName] = regs[i]
+func (a *astExpression) Captures(out map[string]bool) {
+	for _, operand := range a.Operands {
+		operand.Captures(out)
 	}
-	return nil
 }
 
-func (a *astReturnStmt) Captures(out map[string]bool) {
-	a.Value.Captures(out)
+// AsVariable returns the name of the variable, if the expression is just a
+// variable.
+func (a *astExpression) AsVariable() (string, bool) {
+	if len(a.Operands) > 1 || len(a.Operands[0].Operands) > 1 {
+		return "", false
+	}
+	cmp := a.Operands[0].Operands[0]
+	if cmp.Comparison != nil || len(cmp.Sum.Terms) > 0 || len(cmp.Sum.Product.Factors) > 0 {
+		return "", false
+	}
+	call := cmp.Sum.Product.Operand.Call
+	if call == nil || len(call.Calls) > 0 || call.Try || call.Base.Variable == nil || call.Base.StructArguments != nil {
+		return "", false
+	}
+	return *call.Base.Variable, true
 }
 
-func (a *astReturnStmt) Generate(p *program, g *generator) error {
-	regs, err := a.Value.Generate(p, g)
-	if err != nil {
-		return err
+func (a *astExpression) Generate(p *program, b *generator) ([]register, error) {
+	if len(a.Operands) == 1 {
+		return a.Operands[0].Generate(p, b)
 	}
 
-	if len(g.ReturnKind) != len(regs) {
-		return fmt.Errorf("arg count mismatch: %d vs. %d", len(g.ReturnKind), len(regs))
+	result, err := generateOperand(p, b, a.Operands[0], "lhs")
+	if err != nil {
+		return nil, err
 	}
-	for i, reg := range regs {
-		if err := g.Registers[reg].CanConvertTo(*g.ReturnKind[i]); err != nil {
-			return err
+	for _, operand := range a.Operands[1:] {
+		result, err = buildShortCircuit(p, b, "||", result, newSpan(a.Pos, operand.Pos), operand)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return []register{result}, nil
+}
 
-	garbage, err := g.GarbageRegisters(regs)
+func (a *astConjunction) Captures(out map[string]bool) {
+	for _, operand := range a.Operands {
+		operand.Captures(out)
+	}
+}
+
+func (a *astConjunction) Generate(p *program, b *generator) ([]register, error) {
+	if len(a.Operands) == 1 {
+		return a.Operands[0].Generate(p, b)
+	}
+
+	result, err := generateOperand(p, b, a.Operands[0], "lhs")
+	if err != nil {
+		return nil, err
+	}
+	for _, operand := range a.Operands[1:] {
+		result, err = buildShortCircuit(p, b, "&&", result, newSpan(a.Pos, operand.Pos), operand)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []register{result}, nil
+}
+
+// buildShortCircuit combines two Booleans with "&&" or "||". The right-hand
+// side is generated under its own condition, so that it only runs (and only
+// waits for its inputs) when the left-hand side doesn't decide the result.
+func buildShortCircuit(p *program, b *generator, op string, lhs register, leftSpan Span, rhs operand) (register, error) {
+	if !b.Registers[lhs].IsBooleanLike() {
+		return 0, newError(CodeExpectedBoolean, "expecting boolean on LHS of %s", op).At(leftSpan).
+			WithNote("the left-hand side has type %s", b.Registers[lhs])
+	}
+
+	boolean := p.MustResolveBuiltinType("Boolean")
+	result := b.NewReg(boolean, true)
+	b.ReassembleAll()
+
+	parentCondition := b.CurrentCondition
+	evaluate := b.NewCondition()
+	decided := b.NewCondition()
+	if op == "&&" {
+		b.Stmt(&genBranch{lhs, evaluate, decided})
+	} else {
+		b.Stmt(&genBranch{lhs, decided, evaluate})
+	}
+
+	registers := make([]*Kind, len(b.Registers))
+	copy(registers, b.Registers)
+	localsAtStart := b.CopyOfLocals()
+
+	b.CurrentCondition = evaluate
+	value, err := generateOperand(p, b, rhs, "rhs")
+	if err == nil && !b.Registers[value].IsBooleanLike() {
+		err = newError(CodeExpectedBoolean, "expecting boolean on RHS of %s", op).At(rhs.Span()).
+			WithNote("the right-hand side has type %s", b.Registers[value])
+	}
+	if err != nil {
+		b.CurrentCondition = parentCondition
+		return 0, err
+	}
+	b.Stmt(&genRenameRegister{value, result})
+	b.ReassembleAll()
+	evaluated := b.EndBranch(evaluate, len(registers))
+
+	// The value of the left-hand side is the result.
+	b.CurrentCondition = decided
+	copy(b.Registers[:len(registers)], registers)
+	decidedValue := int64(0)
+	if op == "||" {
+		decidedValue = 1
+	}
+	b.Stmt(&genIntegerLiteral{result, decidedValue})
+
+	b.CurrentCondition = parentCondition
+	if err := b.MergeBranches(op, localsAtStart, evaluated, branch{Condition: decided, Locals: localsAtStart}); err != nil {
+		return 0, err.At(rhs.Span())
+	}
+	return result, nil
+}
+
+func (a *astComparisonExpression) Captures(out map[string]bool) {
+	a.Sum.Captures(out)
+	if a.Comparison != nil {
+		a.Comparison.Operand.Captures(out)
+	}
+}
+
+func (a *astComparisonExpression) Generate(p *program, b *generator) ([]register, error) {
+	if a.Comparison == nil {
+		return a.Sum.Generate(p, b)
+	}
+
+	lhs, err := generateOperand(p, b, a.Sum, "lhs")
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := generateOperand(p, b, a.Comparison.Operand, "rhs")
+	if err != nil {
+		return nil, err
+	}
+
+	left, right := b.Registers[lhs], b.Registers[rhs]
+	result := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+
+	if a.Comparison.Cond == "==" || a.Comparison.Cond == "!=" {
+		if left.Family != right.Family || left.Label != right.Label {
+			return nil, newError(CodeTypeMismatch, "cannot compare %s with %s", left, right).At(a.Span())
+		}
+		switch left.Family {
+		case FamilyInteger, FamilyBoolean:
+			b.Stmt(&genIntegerComparison{Operation: a.Comparison.Cond, Left: lhs, Right: rhs, Result: result})
+		case FamilyString:
+			b.Stmt(&genStringComparison{Operation: a.Comparison.Cond, Left: lhs, Right: rhs, Result: result})
+		default:
+			return nil, newError(CodeTypeMismatch, "cannot compare values of type %s", left).At(a.Span()).
+				WithNote("only Integer, Boolean and String values can be compared")
+		}
+		return []register{result}, nil
+	}
+
+	if !left.IsNumeric() {
+		return nil, newError(CodeExpectedNumber, "expecting number on LHS").At(a.Sum.Span()).
+			WithNote("the left-hand side has type %s", left)
+	}
+	if !right.IsNumeric() {
+		return nil, newError(CodeExpectedNumber, "expecting number on RHS").At(a.Comparison.Operand.Span()).
+			WithNote("the right-hand side has type %s", right)
+	}
+
+	b.Stmt(&genIntegerComparison{Operation: a.Comparison.Cond, Left: lhs, Right: rhs, Result: result})
+	return []register{result}, nil
+}
+
+// An operand is an expression on either side of a binary operator.
+type operand interface {
+	Generate(*program, *generator) ([]register, error)
+	Span() Span
+}
+
+// generateOperand generates one side of a binary operator, which must have
+// exactly one value.
+func generateOperand(p *program, b *generator, operand operand, side string) (register, error) {
+	regs, err := operand.Generate(p, b)
+	if err != nil {
+		return 0, err
+	}
+	if len(regs) != 1 {
+		return 0, newError(CodeArity, "expecting single valued %s %v", side, regs).At(operand.Span())
+	}
+	return regs[0], nil
+}
+
+// buildBinaryOperator applies an arithmetic operator to two values. Integers
+// support every operator, and "+" also concatenates strings.
+func buildBinaryOperator(p *program, b *generator, op string, lhs, rhs register, leftSpan, rightSpan Span) (register, error) {
+	left, right := b.Registers[lhs], b.Registers[rhs]
+
+	if op == "+" && left.Family == FamilyString && right.Family == FamilyString {
+		results, err := emitCall(p, b, "concat", []register{lhs, rhs}, []*Kind{left, right})
+		if err != nil {
+			return 0, asDiagnostic(CodeTypeMismatch, err).At(newSpan(leftSpan.Start, rightSpan.End))
+		}
+		return results[0], nil
+	}
+
+	if !left.IsNumeric() {
+		diag := newError(CodeExpectedNumber, "expecting number on LHS of %s", op).At(leftSpan).
+			WithNote("the left-hand side has type %s", left)
+		if op == "+" {
+			diag.WithNote("+ adds two Integers, or concatenates two Strings")
+		}
+		return 0, diag
+	}
+	if !right.IsNumeric() {
+		diag := newError(CodeExpectedNumber, "expecting number on RHS of %s", op).At(rightSpan).
+			WithNote("the right-hand side has type %s", right)
+		if op == "+" {
+			diag.WithNote("+ adds two Integers, or concatenates two Strings")
+		}
+		return 0, diag
+	}
+
+	result := b.NewReg(p.MustResolveBuiltinType("Integer"), true)
+	b.Stmt(&genIntegerArithmetic{Operation: op, Left: lhs, Right: rhs, Result: result})
+	return result, nil
+}
+
+func (a *astExpressionSum) Captures(out map[string]bool) {
+	a.Product.Captures(out)
+	for _, term := range a.Terms {
+		term.Operand.Captures(out)
+	}
+}
+
+func (a *astExpressionSum) Generate(p *program, b *generator) ([]register, error) {
+	if len(a.Terms) == 0 {
+		return a.Product.Generate(p, b)
+	}
+
+	result, err := generateOperand(p, b, a.Product, "lhs")
+	if err != nil {
+		return nil, err
+	}
+	leftSpan := a.Product.Span()
+	for _, term := range a.Terms {
+		rhs, err := generateOperand(p, b, term.Operand, "rhs")
+		if err != nil {
+			return nil, err
+		}
+		result, err = buildBinaryOperator(p, b, term.Op, result, rhs, leftSpan, term.Operand.Span())
+		if err != nil {
+			return nil, err
+		}
+		leftSpan = newSpan(a.Pos, term.EndPos)
+	}
+	return []register{result}, nil
+}
+
+func (a *astExpressionProduct) Captures(out map[string]bool) {
+	a.Operand.Captures(out)
+	for _, factor := range a.Factors {
+		factor.Operand.Captures(out)
+	}
+}
+
+func (a *astExpressionProduct) Generate(p *program, b *generator) ([]register, error) {
+	if len(a.Factors) == 0 {
+		return a.Operand.Generate(p, b)
+	}
+
+	result, err := generateOperand(p, b, a.Operand, "lhs")
+	if err != nil {
+		return nil, err
+	}
+	leftSpan := a.Operand.Span()
+	for _, factor := range a.Factors {
+		rhs, err := generateOperand(p, b, factor.Operand, "rhs")
+		if err != nil {
+			return nil, err
+		}
+		result, err = buildBinaryOperator(p, b, factor.Op, result, rhs, leftSpan, factor.Operand.Span())
+		if err != nil {
+			return nil, err
+		}
+		leftSpan = newSpan(a.Pos, factor.EndPos)
+	}
+	return []register{result}, nil
+}
+
+func (a *astExpressionUnary) Captures(out map[string]bool) {
+	if a.Not != nil {
+		a.Not.Captures(out)
+	} else {
+		a.Call.Captures(out)
+	}
+}
+
+func (a *astExpressionUnary) Generate(p *program, b *generator) ([]register, error) {
+	if a.Not == nil {
+		return a.Call.Generate(p, b)
+	}
+
+	input, err := generateOperand(p, b, a.Not, "operand")
+	if err != nil {
+		return nil, err
+	}
+	if !b.Registers[input].IsBooleanLike() {
+		return nil, newError(CodeExpectedBoolean, "expecting boolean after !").At(a.Not.Span()).
+			WithNote("the operand has type %s", b.Registers[input])
+	}
+
+	result := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+	b.Stmt(&genNot{input, result})
+	return []register{result}, nil
+}
+
+// tryCapture is recorded by Captures for each ?, so that a loop knows to carry
+// an Error out of its body. It can't be the name of a variable.
+const tryCapture = "?"
+
+func (a *astExpressionCall) Captures(out map[string]bool) {
+	if a.Try {
+		out[tryCapture] = true
+	}
+	a.Base.Captures(out)
+	for _, call := range a.Calls {
+		for _, arg := range call.Args {
+			arg.Captures(out)
+		}
+	}
+	for _, arg := range a.With {
+		arg.Value.Captures(out)
+	}
+}
+
+// Path returns the variable and fields being accessed, if the expression is a
+// variable followed by zero or more field names.
+func (a *astExpressionCall) Path() (string, []string, bool) {
+	if len(a.Calls) > 0 || a.Base.Variable == nil || a.Base.StructArguments != nil {
+		return "", nil, false
+	}
+	if *a.Base.Variable == "true" || *a.Base.Variable == "false" {
+		return "", nil, false
+	}
+	return *a.Base.Variable, a.Fields, true
+}
+
+func (a *astExpressionCall) Generate(p *program, b *generator) ([]register, error) {
+	regs, err := a.generateValue(p, b)
+	if err != nil || !a.Try {
+		return regs, err
+	}
+	if len(regs) != 1 {
+		return nil, newError(CodeArity, "cannot use ? on a multi-variable value").At(a.Span())
+	}
+	reg, err := propagateError(p, b, regs[0], a.Span())
+	if err != nil {
+		return nil, err
+	}
+	return []register{reg}, nil
+}
+
+func (a *astExpressionCall) generateValue(p *program, b *generator) ([]register, error) {
+	if len(a.With) > 0 {
+		reg, err := a.generateWith(p, b)
+		if err != nil {
+			return nil, err
+		}
+		return []register{reg}, nil
+	}
+
+	if name, fields, ok := a.Path(); ok && len(fields) > 0 {
+		reg, _, err := accessField(p, b, name, fields, a.Span(), false)
+		if err != nil {
+			return nil, err
+		}
+		return []register{reg}, nil
+	}
+
+	regs, err := a.generateCalls(p, b)
+	if err != nil || len(a.Fields) == 0 {
+		return regs, err
+	}
+	if len(regs) != 1 {
+		return nil, newError(CodeArity, "cannot access a field of a multi-variable value").At(a.Span())
+	}
+
+	// Fields of temporary values aren't tracked as variables.
+	reg := regs[0]
+	for _, field := range a.Fields {
+		if reg, err = readField(p, b, reg, field, a.Span()); err != nil {
+			return nil, err
+		}
+	}
+	return []register{reg}, nil
+}
+
+func (a *astExpressionCall) generateCalls(p *program, b *generator) ([]register, error) {
+	if len(a.Calls) == 0 {
+		return a.Base.Generate(p, b)
+	}
+
+	// Functions are called by name, unless a local variable hides them.
+	calls := a.Calls
+	var regs []register
+	var err error
+	if name := a.Base.Variable; name != nil && a.Base.StructArguments == nil && !b.IsLocal(*name) {
+		regs, err = buildMethodCall(p, b, *name, a.Base.Span(), calls[0].Args)
+		calls = calls[1:]
+	} else {
+		regs, err = a.Base.Generate(p, b)
+	}
+
+	for _, call := range calls {
+		if err != nil {
+			return nil, err
+		}
+		if len(regs) != 1 {
+			return nil, newError(CodeArity, "cannot call a multi-variable value").At(a.Span())
+		}
+		regs, err = buildValueCall(p, b, regs[0], a.Base.Span(), call.Args)
+	}
+	return regs, err
+}
+
+// generateWith builds a copy of a struct with some of its fields replaced. The
+// original struct is consumed, and the fields being replaced are deleted.
+func (a *astExpressionCall) generateWith(p *program, b *generator) (register, error) {
+	var kind *Kind
+	fieldRegs := []register{}
+	base := ""
+
+	if name, fields, ok := a.Path(); ok {
+		// Variables are exploded first, so that the new values can refer to
+		// the fields they replace.
+		base = strings.Join(append([]string{name}, fields...), ".")
+		if _, ok := b.Locals[base]; ok || b.Exploded[base].Kind == nil {
+			reg, local, err := accessField(p, b, name, fields, a.Span(), true)
+			if err != nil {
+				return 0, err
+			}
+			if err := checkUpdatable(p, b.Registers[reg], a.Span()); err != nil {
+				return 0, err
+			}
+			if local == "" {
+				return 0, newError(CodeBadBorrow, "cannot update a field of a borrowed struct").At(a.Span())
+			}
+			explode(p, b, local, reg, a.Span())
+		}
+		kind = b.Exploded[base].Kind
+	} else {
+		regs, err := a.generateCalls(p, b)
+		if err != nil {
+			return 0, err
+		}
+		if len(regs) != 1 {
+			return 0, newError(CodeArity, "cannot update a multi-variable value").At(a.Span())
+		}
+		reg := regs[0]
+		for _, field := range a.Fields {
+			if reg, err = readField(p, b, reg, field, a.Span()); err != nil {
+				return 0, err
+			}
+		}
+
+		kind = b.Registers[reg]
+		if err := checkUpdatable(p, kind, a.Span()); err != nil {
+			return 0, err
+		}
+		for _, fieldKind := range kind.UnpackAsTuple() {
+			fieldRegs = append(fieldRegs, b.NewReg(fieldKind, true))
+		}
+		b.Stmt(&genUnpackTuple{Input: reg, Results: fieldRegs})
+		b.Forget(b.ResolveRegister(reg))
+	}
+
+	strct := p.structOf(kind)
+	values := map[int]register{}
+	spans := map[int]Span{}
+	for _, arg := range a.With {
+		if arg.Name == nil {
+			return 0, newError(CodeMissingField, "updated fields must be named").At(arg.Span()).
+				WithNote("write \"field: value\" for each field to replace")
+		}
+		index, err := fieldIndex(p, kind, *arg.Name, arg.Span())
+		if err != nil {
+			return 0, err
+		}
+		if previous, ok := spans[index]; ok {
+			return 0, newError(CodeMissingField, "field \"%s\" is updated twice", *arg.Name).At(arg.Span()).
+				WithRelated(previous, "first updated here")
+		}
+		spans[index] = arg.Span()
+
+		regs, err := arg.Value.Generate(p, b)
+		if err != nil {
+			return 0, err
+		}
+		if len(regs) != 1 {
+			return 0, newError(CodeArity, "cannot use multi-variable value as a field").At(arg.Value.Span())
+		}
+		value, err := convertTo(b, regs[0], kind.UnpackAsTuple()[index], arg.Value.Span())
+		if err != nil {
+			return 0, asDiagnostic(CodeTypeMismatch, err).At(arg.Value.Span())
+		}
+		values[index] = value
+	}
+
+	if base != "" {
+		fieldRegs = make([]register, len(strct.Fields))
+	}
+	for i, field := range strct.Fields {
+		value, replaced := values[i]
+		old, hasOld := fieldRegs[i], base == ""
+		if base != "" && replaced {
+			old, hasOld = b.Locals[base+"."+field.Name]
+			delete(b.Locals, base+"."+field.Name)
+		} else if base != "" {
+			reg, err := b.Lookup(base+"."+field.Name, a.Span())
+			if err != nil {
+				// Report the field as having been moved out of the struct.
+				_, err = b.Lookup(base, a.Span())
+				return 0, err
+			}
+			fieldRegs[i] = reg
+		}
+		if !replaced {
+			continue
+		}
+
+		if kind := b.Registers[old]; hasOld && kind != nil && kind.NeedsToBeDeleted() && !kind.CanBeImplicitlyDeleted() {
+			return 0, newError(CodeUnusedValue, "replacing field \"%s\" would discard a value of type %s", field.Name, kind).
+				At(spans[i]).
+				WithNote("move %s out of the struct before replacing it", field.Name)
+		}
+		fieldRegs[i] = value
+	}
+
+	result := b.NewReg(&Kind{false, FamilyTuple, kind.UnpackAsTuple(), kind.Label, kind.TypeArgs, nil}, true)
+	b.Stmt(&genMakeTuple{Inputs: fieldRegs, Result: result})
+	for _, reg := range fieldRegs {
+		b.Consume(b.ResolveRegister(reg), a.Span())
+	}
+	if base != "" {
+		delete(b.Exploded, base)
+		b.ConsumedLocals[base] = a.Span()
+	}
+	return result, nil
+}
+
+// checkUpdatable makes sure that a value is an owned struct with named fields.
+func checkUpdatable(p *program, kind *Kind, span Span) error {
+	if strct := p.structOf(kind); strct == nil || !strct.HasNamedFields() {
+		return newError(CodeUnknownField, "%s has no named fields to update", kind).At(span)
+	}
+	if kind.Borrowed {
+		return newError(CodeBadBorrow, "cannot update borrowed struct %s", kind).At(span).
+			WithNote("only an owned struct can be taken apart to build a new one")
+	}
+	return nil
+}
+
+// structOf returns the definition of a struct type, or nil if the kind isn't
+// a struct.
+func (p *program) structOf(kind *Kind) *astStruct {
+	if kind.Family != FamilyTuple {
+		return nil
+	}
+	return p.Types[kind.Label]
+}
+
+// fieldIndex finds a named field of a struct.
+func fieldIndex(p *program, kind *Kind, field string, span Span) (int, error) {
+	strct := p.structOf(kind)
+	if strct == nil {
+		return 0, newError(CodeUnknownField, "%s has no field \"%s\"", kind, field).At(span).
+			WithNote("only structs have fields")
+	}
+	index, ok := strct.FieldIndex(field)
+	if !ok {
+		diag := newError(CodeUnknownField, "%s has no field \"%s\"", strct.Name, field).At(span).
+			WithRelated(strct.Span(), "%s is defined here", strct.Name)
+		if !strct.HasNamedFields() {
+			diag.WithNote("the fields of %s are positional, and can only be read with let", strct.Name)
+		}
+		return 0, diag
+	}
+	return index, nil
+}
+
+// orderStructArgs puts the arguments used to construct a struct in the order
+// of its fields. Either every argument names its field, or none of them do.
+func orderStructArgs(strct *astStruct, args []*astStructArg, span Span) ([]*astExpression, error) {
+	if args[0].Name == nil {
+		if len(args) != len(strct.Fields) {
+			return nil, newError(CodeArity, "%s has %d fields, but %d were given", strct.Name, len(strct.Fields), len(args)).
+				At(span).
+				WithRelated(strct.Span(), "%s is defined here", strct.Name)
+		}
+		result := []*astExpression{}
+		for _, arg := range args {
+			if arg.Name != nil {
+				return nil, newError(CodeMissingField, "cannot mix named and positional fields").At(arg.Span())
+			}
+			result = append(result, arg.Value)
+		}
+		return result, nil
+	}
+
+	result := make([]*astExpression, len(strct.Fields))
+	spans := map[int]Span{}
+	for _, arg := range args {
+		if arg.Name == nil {
+			return nil, newError(CodeMissingField, "cannot mix named and positional fields").At(arg.Span())
+		}
+		index, ok := strct.FieldIndex(*arg.Name)
+		if !ok {
+			return nil, newError(CodeUnknownField, "%s has no field \"%s\"", strct.Name, *arg.Name).
+				At(arg.Span()).
+				WithRelated(strct.Span(), "%s is defined here", strct.Name)
+		}
+		if previous, ok := spans[index]; ok {
+			return nil, newError(CodeMissingField, "field \"%s\" is given twice", *arg.Name).At(arg.Span()).
+				WithRelated(previous, "first given here")
+		}
+		spans[index] = arg.Span()
+		result[index] = arg.Value
+	}
+
+	for i, field := range strct.Fields {
+		if result[i] == nil {
+			return nil, newError(CodeMissingField, "missing field \"%s\" in %s", field.Name, strct.Name).At(span).
+				WithRelated(field.Span(), "\"%s\" is defined here", field.Name)
+		}
+	}
+	return result, nil
+}
+
+// accessField reads name.fields[0].fields[1]..., returning the register
+// holding the field and, if the field is held in a local variable, its name.
+//
+// Primitive fields are copied, and fields of borrowed structs are borrowed.
+// Any other field is moved out of its struct, which explodes the struct into
+// one local per field. The struct can be used again once every field is back
+// in place.
+func accessField(p *program, b *generator, name string, fields []string, span Span, borrow bool) (register, string, error) {
+	local := name
+	reg := register(0)
+	for _, field := range fields {
+		if local != "" {
+			if _, ok := b.Locals[local]; !ok && b.Exploded[local].Kind != nil {
+				local += "." + field
+				continue
+			}
+			var err error
+			if reg, err = b.Lookup(local, span); err != nil {
+				return 0, "", err
+			}
+		}
+
+		kind := b.Registers[reg]
+		index, err := fieldIndex(p, kind, field, span)
+		if err != nil {
+			return 0, "", err
+		}
+
+		if local == "" || kind.Borrowed || kind.UnpackAsTuple()[index].IsPrimitive() {
+			if reg, err = readField(p, b, reg, field, span); err != nil {
+				return 0, "", err
+			}
+			local = ""
+			continue
+		}
+
+		explode(p, b, local, reg, span)
+		local += "." + field
+	}
+
+	if local == "" {
+		return reg, "", nil
+	}
+	reg, err := b.Lookup(local, span)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Primitives are copied, so that the struct they came from stays whole.
+	if kind := b.Registers[reg]; kind.IsPrimitive() && !borrow {
+		result := b.NewReg(kind, true)
+		b.Stmt(&genRenameRegister{reg, result})
+		return result, "", nil
+	}
+	if !borrow {
+		return reg, "", nil
+	}
+	return reg, local, nil
+}
+
+// explode splits the struct held in a local variable into one local per
+// field, named "variable.field".
+func explode(p *program, b *generator, local string, reg register, span Span) {
+	kind := b.Registers[reg]
+	results := []register{}
+	names := []string{}
+	for i, fieldKind := range kind.UnpackAsTuple() {
+		results = append(results, b.NewReg(fieldKind, true))
+		names = append(names, p.structOf(kind).Fields[i].Name)
+	}
+	b.Stmt(&genUnpackTuple{Input: reg, Results: results})
+	b.Consume(b.ResolveRegister(reg), span)
+	for i, result := range results {
+		b.Locals[local+"."+names[i]] = result
+		delete(b.ConsumedLocals, local+"."+names[i])
+	}
+	b.Exploded[local] = explodedStruct{kind, names}
+}
+
+// readField reads a field of a value without tracking it as a variable.
+// Primitive fields and fields of borrowed structs are read in place; any
+// other field is moved out, and the remaining fields are deleted.
+func readField(p *program, b *generator, reg register, field string, span Span) (register, error) {
+	kind := b.Registers[reg]
+	index, err := fieldIndex(p, kind, field, span)
+	if err != nil {
+		return 0, err
+	}
+
+	if kind.Borrowed || kind.UnpackAsTuple()[index].IsPrimitive() {
+		view := *kind.UnpackAsTuple()[index]
+		view.Borrowed = kind.Borrowed && !view.IsPrimitive()
+		result := b.NewReg(&view, true)
+		b.Stmt(&genTupleField{reg, index, result})
+		return result, nil
+	}
+
+	results := []register{}
+	for i, fieldKind := range kind.UnpackAsTuple() {
+		if i != index && fieldKind.NeedsToBeDeleted() && !fieldKind.CanBeImplicitlyDeleted() {
+			return 0, newError(CodeUnusedValue, "reading field \"%s\" would discard a value of type %s", field, fieldKind).
+				At(span).
+				WithNote("store the struct in a variable before reading its fields")
+		}
+		results = append(results, b.NewReg(fieldKind, true))
+	}
+	b.Stmt(&genUnpackTuple{Input: reg, Results: results})
+	b.Forget(b.ResolveRegister(reg))
+	return results[index], nil
+}
+
+func (a *astLetStmt) Captures(out map[string]bool) {
+	a.Value.Captures(out)
+	if a.MustExist {
+		for _, name := range a.VarNames {
+			out[name] = true
+		}
+	}
+}
+
+func (a *astLetStmt) Generate(p *program, b *generator) error {
+	for _, name := range a.VarNames {
+		_, ok := b.Locals[name]
+		if _, exploded := b.Exploded[name]; exploded {
+			ok = true
+		}
+		if ok != a.MustExist {
+			if a.MustExist {
+				diag := newError(CodeUnknownVariable, "Variable %s does not exist", name).At(a.Span())
+				if span, ok := b.ConsumedLocals[name]; ok {
+					diag.WithRelated(span, "\"%s\" was consumed here", name)
+				} else {
+					diag.WithNote("use let to define a new variable")
+				}
+				return diag
+			} else {
+				return newError(CodeVariableExists, "Variable %s already exists", name).At(a.Span()).
+					WithNote("use set to replace the value of an existing variable")
+			}
+		}
+	}
+
+	regs, err := a.Value.Generate(p, b)
+	if err != nil {
+		return err
+	}
+
+	if len(a.VarNames) == 1 {
+		// let a = (b, c)
+		regs = []register{b.MaybeMakeTuple(regs)}
+	}
+
+	if len(regs) == 1 && b.Registers[regs[0]].Family == FamilyTuple && len(a.VarNames) > 1 {
+		// let (b, c) = a
+		original := regs[0]
+
+		if b.Registers[original].Borrowed {
+			return newError(CodeBadBorrow, "cannot unpack unowned tuple").At(a.Value.Span())
+		}
+
+		regs = []register{}
+		for _, kind := range b.Registers[original].UnpackAsTuple() {
+			regs = append(regs, b.NewReg(kind, true))
+		}
+		b.Stmt(&genUnpackTuple{
+			Input:   original,
+			Results: regs,
+		})
+		b.Consume(original, a.Value.Span())
+	}
+
+	if len(regs) != len(a.VarNames) {
+		return newError(CodeArity, "Arity mismatch: %d versus %d", len(regs), len(a.VarNames)).At(a.Value.Span()).
+			WithNote("the value has %d parts, but %d variables are being assigned", len(regs), len(a.VarNames))
+	}
+
+	for i, varName := range a.VarNames {
+		// A value held by another variable, or by a field of an exploded
+		// struct, is moved out of it.
+		if kind := b.Registers[regs[i]]; kind != nil && !kind.IsPrimitive() && !kind.Borrowed {
+			for lcl, reg := range b.Locals {
+				if lcl != varName && b.ResolveRegister(reg) == b.ResolveRegister(regs[i]) {
+					delete(b.Locals, lcl)
+					b.ConsumedLocals[lcl] = a.Value.Span()
+				}
+			}
+		}
+
+		// Whatever is left of an exploded struct is replaced along with it.
+		for _, field := range b.Exploded[varName].Fields {
+			delete(b.Locals, varName+"."+field)
+		}
+		delete(b.Exploded, varName)
+
+		b.Locals[varName] = regs[i]
+		delete(b.Poisoned, varName)
+	}
+	return nil
+}
+
+// convertTo checks that a value can be used where the given kind is expected.
+// A value that is one of the members of an expected union is wrapped in it.
+func convertTo(g *generator, reg register, kind *Kind, span Span) (register, error) {
+	actual := g.Registers[reg]
+	err := actual.CanConvertTo(*kind)
+	if err == nil || kind.Family != FamilyUnion || actual.Family == FamilyUnion {
+		return reg, err
+	}
+
+	for i, member := range kind.UnpackAsUnion() {
+		if actual.CanConvertTo(*member) == nil {
+			result := g.NewReg(kind, true)
+			g.Stmt(&genMakeUnion{reg, i, result})
+			g.Consume(g.ResolveRegister(reg), span)
+			return result, nil
+		}
+	}
+	return reg, err
+}
+
+// propagateError unwraps a Union[T, Error] for the ? operator. If it holds an
+// Error, the function returns it straight away, or inside a loop, leaves the
+// loop with it; otherwise the T is the result, and the code after it only runs
+// once that is known.
+func propagateError(p *program, b *generator, union register, span Span) (register, error) {
+	errorKind, err := p.ResolveType(&TypeRep{Name: "Error"})
+	if err != nil {
+		return 0, asDiagnostic(CodeUnknownType, err).At(span)
+	}
+
+	unionKind := b.Registers[union]
+	errorIndex := -1
+	if unionKind.Family == FamilyUnion && len(unionKind.UnpackAsUnion()) == 2 {
+		for i, member := range unionKind.UnpackAsUnion() {
+			if member.IsEquivalent(*errorKind) == nil {
+				errorIndex = i
+			}
+		}
+	}
+	if errorIndex < 0 {
+		return 0, newError(CodeTypeMismatch, "? needs a Union[T, Error], not %s", unionKind).At(span)
+	}
+	valueKind := unionKind.UnpackAsUnion()[1-errorIndex]
+
+	failed := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+	b.Stmt(&genCheckUnionType{union, errorIndex, failed})
+
+	b.ReassembleAll()
+	parentCondition := b.CurrentCondition
+	failedCondition := b.NewCondition()
+	succeededCondition := b.NewCondition()
+	b.Forget(b.ResolveRegister(union))
+	registers := make([]*Kind, len(b.Registers))
+	copy(registers, b.Registers)
+
+	b.Stmt(&genBranch{failed, failedCondition, succeededCondition})
+	localsAtStart := b.CopyOfLocals()
+
+	b.CurrentCondition = failedCondition
+	returnOrFail := returnError
+	if b.Loop != nil && b.Loop.Status != nil {
+		returnOrFail = b.Loop.fail
+	}
+	if err := returnOrFail(b, union, errorKind, span); err != nil {
+		// Carry on as though the union were never checked, so that the error
+		// doesn't cause others.
+		b.CurrentCondition = parentCondition
+		for i := len(registers); i < len(b.Registers); i++ {
+			b.Registers[i] = nil
+		}
+		copy(b.Registers, registers)
+		b.Locals = localsAtStart
+		return 0, err
+	}
+	ifFailed := b.EndBranch(failedCondition, len(registers))
+	b.Locals = localsAtStart
+	localsAtStart = b.CopyOfLocals()
+	copy(b.Registers[:len(registers)], registers)
+
+	b.CurrentCondition = succeededCondition
+	value := b.NewReg(valueKind, true)
+	b.Stmt(&genExtractUnionValue{union, value})
+	ifSucceeded := b.EndBranch(succeededCondition, len(ifFailed.Registers))
+
+	b.CurrentCondition = parentCondition
+	if err := b.MergeBranches("?", localsAtStart, ifFailed, ifSucceeded); err != nil {
+		return 0, err.At(span)
+	}
+
+	// What follows only runs if there was no Error, so that calls after the ?
+	// aren't started when the function has already returned.
+	b.CurrentCondition = succeededCondition
+	return value, nil
+}
+
+// returnError returns the Error held in union from the function, as whichever
+// of its results can hold an Error. Each of the other results must be an
+// effect, like FileSystem, which is returned from the only variable holding
+// one.
+func returnError(b *generator, union register, errorKind *Kind, span Span) error {
+	results := make([]register, len(b.ReturnKind))
+	errorResult := -1
+	for i, kind := range b.ReturnKind {
+		holdsError := kind.IsEquivalent(*errorKind) == nil
+		if kind.Family == FamilyUnion {
+			for _, member := range kind.UnpackAsUnion() {
+				holdsError = holdsError || member.IsEquivalent(*errorKind) == nil
+			}
+		}
+		if !holdsError {
+			continue
+		} else if errorResult >= 0 {
+			return newError(CodeTypeMismatch, "? can't tell which result should hold the Error").At(span).
+				WithNote("results %d and %d can both hold an Error", errorResult+1, i+1)
+		}
+		errorResult = i
+	}
+	if errorResult < 0 {
+		return newError(CodeTypeMismatch, "? can only be used in a function that can return an Error").At(span).
+			WithNote("the function has type %s", formatFuncType(b.ArgKinds, b.ReturnKind))
+	}
+
+	used := map[string]bool{}
+	for i, kind := range b.ReturnKind {
+		if i == errorResult {
+			continue
+		}
+		if !kind.IsEffect() {
+			return newError(CodeTypeMismatch, "? can't return %s along with the Error", kind).At(span).
+				WithNote("only effects, like FileSystem, are returned from the variables holding them")
+		}
+
+		candidates := []string{}
+		for name, reg := range b.Locals {
+			if !used[name] && b.Registers[reg] != nil && b.Registers[reg].IsEquivalent(*kind) == nil {
+				candidates = append(candidates, name)
+			}
+		}
+		sort.Strings(candidates)
+		if len(candidates) != 1 {
+			err := newError(CodeTypeMismatch, "? can't tell which %s to return along with the Error", kind).At(span)
+			if len(candidates) == 0 {
+				return err.WithNote("no variable holds a %s", kind)
+			}
+			return err.WithNote("it could be any of %s", strings.Join(candidates, ", "))
+		}
+		used[candidates[0]] = true
+		results[i] = b.Locals[candidates[0]]
+	}
+
+	value := b.NewReg(errorKind, true)
+	b.Stmt(&genExtractUnionValue{union, value})
+	converted, err := convertTo(b, value, b.ReturnKind[errorResult], span)
+	if err != nil {
+		return asDiagnostic(CodeTypeMismatch, err).At(span)
+	}
+	results[errorResult] = converted
+
+	garbage, err := b.GarbageRegisters(results)
+	if err != nil {
+		return asDiagnostic(CodeUnusedValue, err).At(span)
+	}
+	b.Stmt(&genReturn{results, garbage})
+	b.Terminated = true
+	return nil
+}
+
+func (a *astReturnStmt) Captures(out map[string]bool) {
+	a.Value.Captures(out)
+}
+
+func (a *astReturnStmt) Generate(p *program, g *generator) error {
+	regs, err := a.Value.Generate(p, g)
 	if err != nil {
 		return err
 	}
 
+	if len(g.ReturnKind) != len(regs) {
+		return newError(CodeArity, "arg count mismatch: %d vs. %d", len(g.ReturnKind), len(regs)).At(a.Value.Span())
+	}
+	for i, reg := range regs {
+		converted, err := convertTo(g, reg, g.ReturnKind[i], a.Value.Span())
+		if err != nil {
+			return asDiagnostic(CodeTypeMismatch, err).At(a.Value.Span())
+		}
+		regs[i] = converted
+	}
+
+	garbage, err := g.GarbageRegisters(regs)
+	if err != nil {
+		return asDiagnostic(CodeUnusedValue, err).At(a.Span())
+	}
+
 	g.Stmt(&genReturn{regs, garbage})
+	g.Terminated = true
 	return nil
 }
 
@@ -571,13 +1792,28 @@ func (a *astBlock) Captures(out map[string]bool) {
 	}
 }
 
-func (a *astBlock) Generate(p *program, g *generator) error {
+func (a *astBlock) Generate(p *program, g *generator) {
 	for _, stmt := range a.Statements {
+		if g.Terminated {
+			g.Report(stmt.Span(), newError(CodeUnreachable, "unreachable statement").
+				WithNote("it comes after a return, break or continue"))
+			return
+		}
 		if err := stmt.Generate(p, g); err != nil {
-			return fmt.Errorf("%s: %w", stmt.Pos, err)
+			g.Report(stmt.Span(), err)
+
+			// Any variables that this statement should have defined are now
+			// poisoned, so that using them doesn't cause more errors.
+			if stmt.Let != nil {
+				for _, name := range stmt.Let.VarNames {
+					if _, ok := g.Locals[name]; !ok {
+						g.Poisoned[name] = true
+					}
+				}
+			}
 		}
+		g.NameLocals()
 	}
-	return nil
 }
 
 func (a *astStmt) Captures(out map[string]bool) {
@@ -591,6 +1827,12 @@ func (a *astStmt) Captures(out map[string]bool) {
 		a.Cond.Captures(out)
 	} else if a.Repeat != nil {
 		a.Repeat.Captures(out)
+	} else if a.For != nil {
+		a.For.Captures(out)
+	} else if a.Match != nil {
+		a.Match.Captures(out)
+	} else if a.Jump != nil {
+		// Jumps don't read any variables themselves.
 	} else {
 		panic("unknown stmt type")
 	}
@@ -607,29 +1849,90 @@ func (a *astStmt) Generate(p *program, g *generator) error {
 			return err
 		}
 		if len(regs) != 0 {
-			return fmt.Errorf("Expected void return type, got (unused) %v", regs)
+			kinds := []string{}
+			for _, reg := range regs {
+				kinds = append(kinds, g.Registers[reg].String())
+			}
+			return newError(CodeUnusedValue, "Expected void return type, got (unused) %v", regs).At(a.Span()).
+				WithNote("the expression produces %s; assign it with let", strings.Join(kinds, ", "))
 		}
 		return nil
 	} else if a.Cond != nil {
 		return a.Cond.Generate(p, g)
 	} else if a.Repeat != nil {
 		return a.Repeat.Generate(p, g)
+	} else if a.For != nil {
+		return a.For.Generate(p, g)
+	} else if a.Match != nil {
+		return a.Match.Generate(p, g)
+	} else if a.Jump != nil {
+		return a.Jump.Generate(p, g)
 	}
-	return errors.New("Unknown astStmt type")
+	return newError(CodeUnsupported, "Unknown astStmt type").At(a.Span())
 }
 
 func (a *astRepeatStmt) Captures(out map[string]bool) {
+	a.Condition.Captures(out)
 	a.Block.Captures(out)
 }
 
 func (a *astRepeatStmt) Generate(p *program, g *generator) error {
+	captures := map[string]bool{}
+	a.Captures(captures)
+
+	body := func(closure *generator) {
+		a.Block.Generate(p, closure)
+	}
+	condition := func(b *generator) (register, error) {
+		cond, err := a.Condition.Generate(p, b)
+		if err != nil {
+			return 0, err
+		}
+		if len(cond) != 1 {
+			return 0, newError(CodeArity, "got multiple values for while condition").At(a.Condition.Span())
+		}
+		return cond[0], nil
+	}
+	failure, err := generateLoop(p, g, a.Span(), captures, body, nil, condition)
+	if err != nil || failure == nil {
+		return err
+	}
+	_, err = propagateError(p, g, failure.Status, failure.Span)
+	return err
+}
+
+// generateLoop lowers a loop onto a closure that calls itself once per
+// iteration. The captured variables are passed from each iteration to the
+// next, so an iteration can start as soon as the condition is known, and
+// only waits for the variables that it needs. The condition is generated both
+// before the first iteration and after the body and step of each one.
+//
+// If the loop uses ?, it also returns how the loop ended, for the caller to
+// pass on with propagateError once it has tidied up after the loop.
+func generateLoop(p *program, g *generator, span Span, captures map[string]bool, body, step func(*generator), condition func(*generator) (register, error)) (*loopFailure, error) {
+	var status *Kind
+	if captures[tryCapture] {
+		var err error
+		status, err = p.ResolveType(&TypeRep{Name: "Union", Args: []*TypeRep{{Name: "Boolean"}, {Name: "Error"}}})
+		if err != nil {
+			return nil, asDiagnostic(CodeUnknownType, err).At(span)
+		}
+	}
+	failure := (*loopFailure)(nil)
+
 	kinds := []*Kind{}
 	names := []string{}
 	registers := []register{}
 	resultRegisters := []register{}
 
-	captures := map[string]bool{}
-	a.Block.Captures(captures)
+	g.ReassembleAll()
+
+	// The condition comes first, since a ? in it moves the variables that
+	// are passed to the loop.
+	cond, err := condition(g)
+	if err != nil {
+		return nil, err
+	}
 
 	for name := range captures {
 		reg, ok := g.Locals[name]
@@ -647,67 +1950,47 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 
 	// Set up the closure to repeat after completion
 	{
-		closure := g.NewClosure(p, names, kinds, kinds)
-		if err := a.Block.Generate(p, closure); err != nil {
-			return err
-		}
-		childCall := closure.NewChildCall(closure.Name)
-
-		cond, err := a.Condition.Generate(p, closure)
-		if err != nil {
-			return err
-		}
-		if len(cond) != 1 {
-			return fmt.Errorf("got multiple values for while condition")
+		results := kinds
+		if status != nil {
+			results = append(append([]*Kind{}, kinds...), status)
 		}
-
-		continueCondition := closure.NewCondition()
-		exitCondition := closure.NewCondition()
-
-		returnVariables := []register{}
-		for i, lcl := range names {
-			reg, ok := closure.Locals[lcl]
-			if !ok {
-				return fmt.Errorf("captured variable lost during loop: %s", lcl)
-			}
-			if err := closure.Registers[reg].IsEquivalent(*kinds[i]); err != nil {
-				return fmt.Errorf("%s changed type during loop: %w", kinds[i], err)
+		closure := g.NewClosure(p, names, kinds, results)
+		closure.Loop = &loop{names, kinds, closure.NewChildCall(closure.Name), step, condition, status, nil}
+		body(closure)
+		if !closure.Terminated {
+			if err := closure.Loop.next(closure, span); err != nil {
+				return nil, err
 			}
-			returnVariables = append(returnVariables, reg)
 		}
-
-		garbage, err := closure.GarbageRegisters(returnVariables)
-		if err != nil {
-			return err
+		if status != nil {
+			failure = &loopFailure{Span: span}
+			if closure.Loop.Failed != nil {
+				failure.Span = *closure.Loop.Failed
+			}
 		}
 
-		closure.StmtWithCond(0, &genBranch{cond[0], continueCondition, exitCondition})
-		closure.StmtWithCond(continueCondition, &genRestartLoop{returnVariables, childCall, garbage})
-		closure.StmtWithCond(exitCondition, &genReturn{returnVariables, garbage})
-
 		closureName = closure.Name
 	}
 
 	startCondition := g.NewCondition()
 	skipCondition := g.NewCondition()
 
-	cond, err := a.Condition.Generate(p, g)
-	if err != nil {
-		return err
-	}
-	if len(cond) != 1 {
-		return fmt.Errorf("got multiple values for while condition")
-	}
+	g.Stmt(&genBranch{cond, startCondition, skipCondition})
 
-	g.Stmt(&genBranch{cond[0], startCondition, skipCondition})
-	g.StmtWithCond(startCondition, &genCallAsyncFunction{closureName, registers, resultRegisters, g.NewChildCall(closureName)})
+	results := resultRegisters
+	if failure != nil {
+		failure.Status = g.NewReg(status, false)
+		results = append(append([]register{}, resultRegisters...), failure.Status)
+		succeeded(g, skipCondition, status, failure.Status)
+	}
+	g.StmtWithCond(startCondition, &genCallAsyncFunction{closureName, registers, results, g.NewChildCall(closureName)})
 
 	for i, name := range names {
 		before := g.Locals[name]
 		after := resultRegisters[i]
 
 		if err := g.Registers[before].IsEquivalent(*g.Registers[after]); err != nil {
-			return fmt.Errorf("%s changed type during loop: %w", err)
+			return nil, newError(CodeTypeMismatch, "%s changed type during loop: %s", name, err).At(span)
 		}
 
 		g.Registers[before] = nil
@@ -715,16 +1998,288 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 		g.Locals[name] = after
 	}
 
+	return failure, nil
+}
+
+// A loopFailure is the Union[Boolean, Error] that a loop using ? ended with,
+// and the ? that it is blamed on.
+type loopFailure struct {
+	Status register
+	Span   Span
+}
+
+// succeeded sets the status of a loop that wasn't left by a ?, under the
+// given condition.
+func succeeded(g *generator, c condition, status *Kind, result register) {
+	ok := g.NewReg(status.UnpackAsUnion()[0], true)
+	g.StmtWithCond(c, &genIntegerLiteral{ok, 0})
+	g.StmtWithCond(c, &genMakeUnion{ok, 0, result})
+}
+
+// A loop is the closure generated for the body of a loop, which carries the
+// named variables from one iteration to the next. Step, if set, runs at the
+// end of each iteration, before the condition is checked again. Status, if
+// set, is the Union[Boolean, Error] returned after the variables, which holds
+// the Error if a ? left the loop; Failed is where the first such ? is.
+type loop struct {
+	Names     []string
+	Kinds     []*Kind
+	ChildCall childCall
+	Step      func(*generator)
+	Condition func(*generator) (register, error)
+	Status    *Kind
+	Failed    *Span
+}
+
+// carried finds the registers holding the variables that the loop carries,
+// checking that none of them was lost or changed type during the iteration.
+func (l *loop) carried(g *generator, span Span) ([]register, error) {
+	registers := []register{}
+	for i, lcl := range l.Names {
+		reg, ok := g.Locals[lcl]
+		if _, exploded := g.Exploded[lcl]; !ok && exploded {
+			// Explain which field is missing.
+			_, err := g.Lookup(lcl, span)
+			return nil, err
+		} else if !ok {
+			diag := newError(CodeLostVariable, "captured variable lost during loop: %s", lcl).At(span)
+			if span, ok := g.ConsumedLocals[lcl]; ok {
+				diag.WithRelated(span, "\"%s\" was consumed here", lcl)
+			}
+			return nil, diag
+		}
+		if err := g.Registers[reg].IsEquivalent(*l.Kinds[i]); err != nil {
+			return nil, newError(CodeTypeMismatch, "%s changed type during loop: %s", lcl, err).At(span)
+		}
+		registers = append(registers, reg)
+	}
+	return registers, nil
+}
+
+// next ends the current iteration, starting the next one if the condition
+// still holds, or otherwise leaving the loop.
+func (l *loop) next(g *generator, span Span) error {
+	if l.Step != nil {
+		l.Step(g)
+	}
+	g.ReassembleAll()
+
+	cond, err := l.Condition(g)
+	if err != nil {
+		return err
+	}
+
+	carried, err := l.carried(g, span)
+	if err != nil {
+		return err
+	}
+
+	garbage, err := g.GarbageRegisters(carried)
+	if err != nil {
+		return err
+	}
+
+	continueCondition := g.NewCondition()
+	exitCondition := g.NewCondition()
+
+	g.Stmt(&genBranch{cond, continueCondition, exitCondition})
+	g.StmtWithCond(continueCondition, &genRestartLoop{carried, l.ChildCall, garbage})
+	g.StmtWithCond(exitCondition, &genReturn{l.withStatus(g, exitCondition, carried), garbage})
+	g.Terminated = true
+	return nil
+}
+
+// withStatus adds the status of a loop left without an Error to the carried
+// variables, if the loop has one.
+func (l *loop) withStatus(g *generator, c condition, carried []register) []register {
+	if l.Status == nil {
+		return carried
+	}
+	status := g.NewReg(l.Status, true)
+	succeeded(g, c, l.Status, status)
+	return append(append([]register{}, carried...), status)
+}
+
+// exit leaves the loop straight away, handing the carried variables back to
+// the code after it.
+func (l *loop) exit(g *generator, span Span) error {
+	g.ReassembleAll()
+
+	carried, err := l.carried(g, span)
+	if err != nil {
+		return err
+	}
+
+	garbage, err := g.GarbageRegisters(carried)
+	if err != nil {
+		return asDiagnostic(CodeUnusedValue, err).At(span)
+	}
+
+	g.Stmt(&genReturn{l.withStatus(g, g.CurrentCondition, carried), garbage})
+	g.Terminated = true
+	return nil
+}
+
+// fail leaves the loop the same way as break, but with the Error held in
+// union as its status, for the code after the loop to pass on.
+func (l *loop) fail(g *generator, union register, errorKind *Kind, span Span) error {
+	if l.Failed == nil {
+		l.Failed = &span
+	}
+	carried, err := l.carried(g, span)
+	if err != nil {
+		return err
+	}
+
+	value := g.NewReg(errorKind, true)
+	g.Stmt(&genExtractUnionValue{union, value})
+	status, err := convertTo(g, value, l.Status, span)
+	if err != nil {
+		return asDiagnostic(CodeTypeMismatch, err).At(span)
+	}
+	results := append(append([]register{}, carried...), status)
+
+	garbage, err := g.GarbageRegisters(results)
+	if err != nil {
+		return asDiagnostic(CodeUnusedValue, err).At(span)
+	}
+
+	g.Stmt(&genReturn{results, garbage})
+	g.Terminated = true
 	return nil
 }
 
-func (a *astFunction) Generate(p *program) error {
+func (a *astJumpStmt) Generate(p *program, g *generator) error {
+	if g.Loop == nil {
+		return newError(CodeNotInLoop, "%s outside of a loop", a.Keyword).At(a.Span())
+	}
+	if a.Keyword == "break" {
+		return g.Loop.exit(g, a.Span())
+	}
+	return g.Loop.next(g, a.Span())
+}
+
+func (a *astForStmt) Captures(out map[string]bool) {
+	a.Array.Captures(out)
+	inner := map[string]bool{}
+	a.Block.Captures(inner)
+	delete(inner, a.Elem)
+	for name := range inner {
+		out[name] = true
+	}
+}
+
+// Generate lowers the loop onto generateLoop, with the array and the index of
+// the next element as hidden variables carried between iterations. Elements
+// of an owned array are moved out of it, leaving the empty array to be deleted
+// after the loop; elements of a borrowed array are lent to the block, and
+// primitives are always copied.
+func (a *astForStmt) Generate(p *program, g *generator) error {
+	// The hidden variables can't be named in the source, and are distinct
+	// from those of any nested loop.
+	arrayName := fmt.Sprintf("for#%d#array", a.Pos.Offset)
+	indexName := fmt.Sprintf("for#%d#index", a.Pos.Offset)
+
+	if a.Borrow {
+		name, ok := a.Array.AsVariable()
+		if !ok {
+			return newError(CodeBadBorrow, "can only iterate over a borrowed variable").At(a.Array.Span()).
+				WithNote("assign the array to a variable first, or iterate over it without &")
+		}
+		arrayName = name
+	}
+
+	regs, err := a.Array.Generate(p, g)
+	if err != nil {
+		return err
+	}
+	if len(regs) != 1 {
+		return newError(CodeArity, "cannot iterate over a multi-variable value").At(a.Array.Span())
+	}
+	kind := g.Registers[regs[0]]
+	if kind.Family != FamilyArray {
+		return newError(CodeTypeMismatch, "cannot iterate over a value of type %s", kind).At(a.Array.Span())
+	}
+	if kind.TupleOrUnionArgs[0] == nil {
+		return newError(CodeTypeMismatch, "cannot iterate over an array of unknown type").At(a.Array.Span())
+	}
+	elemKind := *kind.TupleOrUnionArgs[0]
+	elemKind.Borrowed = !elemKind.IsPrimitive() && (a.Borrow || kind.Borrowed)
+
+	if !a.Borrow {
+		// The array is moved into the hidden variable.
+		hidden := g.NewReg(kind, true)
+		g.Stmt(&genRenameRegister{regs[0], hidden})
+		g.Consume(g.ResolveRegister(regs[0]), a.Array.Span())
+		g.Locals[arrayName] = hidden
+	}
+	zero := g.NewReg(p.MustResolveBuiltinType("Integer"), true)
+	g.Stmt(&genIntegerLiteral{zero, 0})
+	g.Locals[indexName] = zero
+
+	captures := map[string]bool{arrayName: true, indexName: true}
+	a.Captures(captures)
+
+	body := func(closure *generator) {
+		elem := closure.NewReg(&elemKind, true)
+		closure.Stmt(&genArrayElement{closure.Locals[arrayName], closure.Locals[indexName], elem})
+		closure.Locals[a.Elem] = elem
+		delete(closure.ConsumedLocals, a.Elem)
+
+		a.Block.Generate(p, closure)
+	}
+	step := func(closure *generator) {
+		delete(closure.Locals, a.Elem)
+
+		one := closure.NewReg(p.MustResolveBuiltinType("Integer"), true)
+		next := closure.NewReg(p.MustResolveBuiltinType("Integer"), true)
+		closure.Stmt(&genIntegerLiteral{one, 1})
+		closure.Stmt(&genIntegerArithmetic{"+", closure.Locals[indexName], one, next})
+		closure.Locals[indexName] = next
+	}
+	condition := func(b *generator) (register, error) {
+		length := b.NewReg(p.MustResolveBuiltinType("Integer"), true)
+		cond := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+		b.Stmt(&genArrayLength{b.Locals[arrayName], length})
+		b.Stmt(&genIntegerComparison{"<", b.Locals[indexName], length, cond})
+		return cond, nil
+	}
+	failure, err := generateLoop(p, g, a.Span(), captures, body, step, condition)
+	if err != nil {
+		return err
+	}
+
+	// An owned array is empty by now, so it is deleted whatever its elements
+	// were.
+	delete(g.Locals, indexName)
+	if reg, ok := g.Locals[arrayName]; ok && !a.Borrow {
+		array := g.ResolveRegister(reg)
+		deleted := g.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+		g.Stmt(&genDelete{array, g.Registers[array], deleted})
+		g.Forget(array)
+		delete(g.Locals, arrayName)
+	}
+
+	if failure != nil {
+		_, err = propagateError(p, g, failure.Status, failure.Span)
+	}
+	return err
+}
+
+func (a *astFunction) Generate(p *program) {
+	a.generate(p, a.Name, nil)
+}
+
+// generate builds the code for the function, with the given type arguments
+// substituted for its type parameters.
+func (a *astFunction) generate(p *program, name string, typeArgs map[string]*Kind) {
 	argNames := []string{}
 	argKinds := []*Kind{}
 	for _, arg := range a.Args {
-		resolved, err := p.ResolveType(arg.Kind)
+		resolved, err := p.resolveType(arg.Kind, typeArgs)
 		if err != nil {
-			return err
+			p.Diagnostics.Add(arg.Span(), err)
+			return
 		}
 
 		argNames = append(argNames, arg.Name)
@@ -733,20 +2288,145 @@ func (a *astFunction) Generate(p *program) error {
 
 	resolvedReturn := []*Kind{}
 	for _, rep := range a.ReturnKind {
-		resolved, err := p.ResolveType(rep)
+		resolved, err := p.resolveType(rep, typeArgs)
 		if err != nil {
-			return err
+			p.Diagnostics.Add(rep.Span(), err)
+			return
 		}
 		resolvedReturn = append(resolvedReturn, resolved)
 	}
 
-	function := newGenerator(a.Name, p, argNames, argKinds, resolvedReturn)
+	function := newGenerator(name, p, argNames, argKinds, resolvedReturn)
 	function.IsNative = a.IsNative
+	function.IsSynchronous = a.IsSynchronous
+	function.TypeArgs = typeArgs
 
 	if a.Block != nil {
-		if err := a.Block.Generate(p, function); err != nil {
-			return err
+		a.Block.Generate(p, function)
+	}
+}
+
+// Value makes a function value that calls the function.
+func (a *astFunction) Value(p *program, b *generator, span Span) (register, error) {
+	if len(a.TypeParams) > 0 {
+		return 0, newError(CodeUnsupported, "cannot use generic function %s as a value", a.Name).At(span).
+			WithNote("call %s from a lambda, so that its type arguments can be inferred", a.Name)
+	}
+
+	kind := &Kind{Family: FamilyFunction, Label: "func"}
+	for _, arg := range a.Args {
+		resolved, err := p.ResolveType(arg.Kind)
+		if err != nil {
+			return 0, err
 		}
+		kind.TupleOrUnionArgs = append(kind.TupleOrUnionArgs, resolved)
 	}
-	return nil
+	for _, rep := range a.ReturnKind {
+		resolved, err := p.ResolveType(rep)
+		if err != nil {
+			return 0, err
+		}
+		kind.Results = append(kind.Results, resolved)
+	}
+
+	p.FunctionValues[a.Name] = true
+	result := b.NewReg(kind, true)
+	b.Stmt(&genMakeFunction{Name: a.Name, Result: result})
+	return result, nil
+}
+
+func (a *astLambda) Captures(out map[string]bool) {
+	inner := map[string]bool{}
+	a.Block.Captures(inner)
+	for _, arg := range a.Args {
+		delete(inner, arg.Name)
+	}
+	delete(inner, tryCapture)
+	for name := range inner {
+		out[name] = true
+	}
+}
+
+// Generate builds the body of the lambda as a closure, and makes a function
+// value holding the variables that it captures. Since the function value can
+// be called any number of times, and can outlive the variables around it,
+// primitives are copied into it, and Strings, Arrays and other functions are
+// moved into it (and lent to its body). Anything else must be passed as an
+// argument.
+func (a *astLambda) Generate(p *program, b *generator) (register, error) {
+	kind := &Kind{Family: FamilyFunction, Label: "func"}
+	argNames := []string{}
+	for _, arg := range a.Args {
+		resolved, err := p.resolveType(arg.Kind, b.TypeArgs)
+		if err != nil {
+			return 0, err
+		}
+		argNames = append(argNames, arg.Name)
+		kind.TupleOrUnionArgs = append(kind.TupleOrUnionArgs, resolved)
+	}
+	for _, rep := range a.ReturnKind {
+		resolved, err := p.resolveType(rep, b.TypeArgs)
+		if err != nil {
+			return 0, err
+		}
+		kind.Results = append(kind.Results, resolved)
+	}
+
+	captures := map[string]bool{}
+	a.Captures(captures)
+	names := []string{}
+	for name := range captures {
+		_, local := b.Locals[name]
+		_, exploded := b.Exploded[name]
+		if local || exploded {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	argKinds := append([]*Kind{}, kind.TupleOrUnionArgs...)
+	captured := []register{}
+	frees := []string{}
+	for _, name := range names {
+		reg, err := b.Lookup(name, a.Span())
+		if err != nil {
+			return 0, err
+		}
+
+		captureKind := *b.Registers[reg]
+		if !captureKind.IsPrimitive() && !captureKind.CanBeImplicitlyDeleted() {
+			return 0, newError(CodeBadCapture, "cannot capture \"%s\" of type %s in a lambda", name, &captureKind).At(a.Span()).
+				WithNote("a lambda can be called any number of times, so pass %s to it as an argument instead", name)
+		} else if !captureKind.IsPrimitive() && captureKind.Borrowed {
+			return 0, newError(CodeBadCapture, "cannot capture borrowed variable \"%s\" in a lambda", name).At(a.Span()).
+				WithNote("the lambda could outlive %s, so pass a copy of it instead", name)
+		}
+
+		free := ""
+		if captureKind.Family == FamilyFunction {
+			free = "unique_effect_function_free"
+		} else if !captureKind.IsPrimitive() {
+			free = "free"
+		}
+		captureKind.Borrowed = !captureKind.IsPrimitive()
+
+		argNames = append(argNames, name)
+		argKinds = append(argKinds, &captureKind)
+		captured = append(captured, reg)
+		frees = append(frees, free)
+	}
+
+	closure := b.NewClosure(p, argNames, argKinds, kind.Results)
+	closure.IsFunctionValue = true
+	closure.Captured = len(names)
+	a.Block.Generate(p, closure)
+
+	result := b.NewReg(kind, true)
+	b.Stmt(&genMakeFunction{closure.Name, captured, frees, result})
+	for i, reg := range captured {
+		if frees[i] != "" {
+			b.Consume(b.ResolveRegister(reg), a.Span())
+		}
+	}
+	return result, nil
 }
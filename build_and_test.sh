@@ -17,8 +17,10 @@
 set -euo pipefail
 
 mkdir -p gen/binaries/ gen/sources/ gen/outputs/
+export UNIQUE_EFFECT_TRACE=gen/outputs/trace.json
 
 go install github.com/fatlotus/unique_effect/...
+go test ./...
 
 go get github.com/kisielk/errcheck
 errcheck -exclude errcheck_exclude.txt ./...
@@ -26,25 +28,49 @@ errcheck -exclude errcheck_exclude.txt ./...
 go get github.com/gordonklaus/ineffassign
 ineffassign ./...
 
-for features in '' '-DUSE_LIBUV -luv'; do
+for features in '' '-DUSE_LIBUV -luv' '-DUSE_LIBUV -DUSE_VIRTUAL_CLOCK -luv' \
+    '-DUSE_THREADS -pthread' '-DUSE_THREADS -DUSE_TRACE -pthread'; do
   if ! clang -o gen/binaries/detect gen/feature_detect.c ${features}; then
     echo "Skipping feature ${features}"
     continue
   fi
 
   for filename in examples/*.ht; do
-    if [[ "${filename}" == "examples/stdlib.ht" ]]; then
+    module="$(basename "${filename}" .ht)"
+
+    # Skip libraries (like stdlib.ht) and programs that must fail to compile.
+    if [[ ! -f "examples/${module}_output.txt" ]]; then
       continue
     fi
 
-    module="$(basename "${filename}" .ht)"
+    # Programs can say which arguments to run with, and their exit status.
+    args=()
+    if line="$(grep -m 1 '^// args: ' "${filename}")"; then
+      eval "args=(${line#// args: })"
+    fi
+    expected_status="$(sed -n 's|^// expect-exit: ||p' "${filename}")"
+    stdin=/dev/null
+    if [[ -f "examples/${module}_stdin.txt" ]]; then
+      stdin="examples/${module}_stdin.txt"
+    fi
 
-    unique_effect "${module}"
+    unique_effect -o gen/sources -I examples "${filename}"
     clang -Wall -Wpedantic -g -o "gen/binaries/${module}" -fsanitize=address \
-      gen/builtins.c "gen/sources/${module}.c" ${features}
-    "gen/binaries/${module}" \
-      | tee "gen/outputs/${module}.txt"
+      -I gen gen/builtins.c "gen/sources/${module}.c" ${features}
+    status=0
+    "gen/binaries/${module}" ${args[@]+"${args[@]}"} < "${stdin}" \
+      > "gen/outputs/${module}.txt" 2> "gen/outputs/${module}_stderr.txt" \
+      || status=$?
+    cat "gen/outputs/${module}.txt"
+    cat "gen/outputs/${module}_stderr.txt" >&2
+    if [[ "${status}" != "${expected_status:-0}" ]]; then
+      echo "${module} exited with status ${status}, expected ${expected_status:-0}"
+      exit 1
+    fi
     diff -U 3 "gen/outputs/${module}.txt" "examples/${module}_output.txt"
+    if [[ -f "examples/${module}_stderr.txt" ]]; then
+      diff -U 3 "gen/outputs/${module}_stderr.txt" "examples/${module}_stderr.txt"
+    fi
   done
 done
 
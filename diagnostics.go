@@ -0,0 +1,356 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// errReported is returned by code generation when the problem has already
+// been recorded as a diagnostic (for example, when reading a variable whose
+// definition failed to compile), so that it isn't reported twice.
+var errReported = errors.New("error already reported")
+
+// Codes identify each kind of diagnostic, so that editors and documentation
+// can refer to them without matching on the message.
+const (
+	CodeSyntax              = "E0001"
+	CodeUnknownModule       = "E0002"
+	CodeDuplicateDefinition = "E0003"
+	CodeNoMain              = "E0004"
+
+	CodeUnknownVariable  = "E0100"
+	CodeConsumedVariable = "E0101"
+	CodeVariableExists   = "E0102"
+	CodeBadBorrow        = "E0103"
+	CodeLostVariable     = "E0104"
+	CodeBadCapture       = "E0105"
+
+	CodeTypeMismatch    = "E0200"
+	CodeArity           = "E0201"
+	CodeExpectedNumber  = "E0202"
+	CodeExpectedBoolean = "E0203"
+	CodeUnknownType     = "E0204"
+	CodeUnknownFunction = "E0205"
+	CodeBadTypeSwitch   = "E0206"
+	CodeNonExhaustive   = "E0207"
+	CodeDuplicateArm    = "E0208"
+	CodeUnknownField    = "E0209"
+	CodeMissingField    = "E0210"
+
+	CodeUnusedValue = "E0300"
+	CodeUnreachable = "E0301"
+	CodeNotInLoop   = "E0302"
+	CodeUnsupported = "E0400"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// A Span is the range of source text from Start up to (but not including)
+// End.
+type Span struct {
+	Start lexer.Position
+	End   lexer.Position
+}
+
+func newSpan(start, end lexer.Position) Span {
+	return Span{start, end}
+}
+
+func (s Span) IsZero() bool {
+	return s.Start.Line == 0
+}
+
+func (s Span) MarshalJSON() ([]byte, error) {
+	if s.IsZero() {
+		return []byte("null"), nil
+	}
+	type location struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+		Offset int `json:"offset"`
+	}
+	end := s.End
+	if end.Line == 0 {
+		end = s.Start
+	}
+	return json.Marshal(struct {
+		File  string   `json:"file"`
+		Start location `json:"start"`
+		End   location `json:"end"`
+	}{
+		s.Start.Filename,
+		location{s.Start.Line, s.Start.Column, s.Start.Offset},
+		location{end.Line, end.Column, end.Offset},
+	})
+}
+
+// A Label points at some other source text that helps explain a diagnostic,
+// such as the place where a variable was consumed.
+type Label struct {
+	Span    Span   `json:"span"`
+	Message string `json:"message"`
+}
+
+// A Diagnostic is a problem found while compiling a program.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Message  string   `json:"message"`
+	Span     Span     `json:"span"`
+	Related  []Label  `json:"related,omitempty"`
+	Notes    []string `json:"notes,omitempty"`
+}
+
+// newError creates an error diagnostic. Its span is filled in when it's
+// reported, unless it is given one first with At.
+func newError(code string, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{Severity: SeverityError, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// asDiagnostic gives err the code if it doesn't already have one.
+func asDiagnostic(code string, err error) *Diagnostic {
+	if diag, ok := err.(*Diagnostic); ok {
+		return diag
+	}
+	return newError(code, "%s", err)
+}
+
+func (d *Diagnostic) At(span Span) *Diagnostic {
+	d.Span = span
+	return d
+}
+
+func (d *Diagnostic) WithRelated(span Span, format string, args ...interface{}) *Diagnostic {
+	d.Related = append(d.Related, Label{span, fmt.Sprintf(format, args...)})
+	return d
+}
+
+func (d *Diagnostic) WithNote(format string, args ...interface{}) *Diagnostic {
+	d.Notes = append(d.Notes, fmt.Sprintf(format, args...))
+	return d
+}
+
+func (d *Diagnostic) Error() string {
+	if d.Span.IsZero() {
+		return d.Message
+	}
+	return fmt.Sprintf("%s: %s", d.Span.Start, d.Message)
+}
+
+// Render writes the diagnostic in the style of rustc, quoting the lines of
+// source that it refers to. readFile is used to find the source; spans in
+// files that can't be read are shown by position alone.
+func (d *Diagnostic) Render(w io.Writer, readFile func(filename string) ([]byte, error)) {
+	if d.Code != "" {
+		fmt.Fprintf(w, "%s[%s]: %s\n", d.Severity, d.Code, d.Message)
+	} else {
+		fmt.Fprintf(w, "%s: %s\n", d.Severity, d.Message)
+	}
+
+	labels := []Label{}
+	if !d.Span.IsZero() {
+		labels = append(labels, Label{Span: d.Span})
+	}
+	for _, related := range d.Related {
+		if !related.Span.IsZero() {
+			labels = append(labels, related)
+		}
+	}
+
+	gutter := 1
+	for _, label := range labels {
+		if width := len(fmt.Sprint(label.Span.Start.Line)); width > gutter {
+			gutter = width
+		}
+	}
+	margin := strings.Repeat(" ", gutter)
+
+	// Labels are grouped by file, starting with the one the diagnostic is in,
+	// and shown in source order within each file.
+	for len(labels) > 0 {
+		filename := labels[0].Span.Start.Filename
+		group := []Label{}
+		rest := []Label{}
+		for _, label := range labels {
+			if label.Span.Start.Filename == filename {
+				group = append(group, label)
+			} else {
+				rest = append(rest, label)
+			}
+		}
+		labels = rest
+
+		arrow := ":::"
+		if group[0].Message == "" {
+			arrow = "-->"
+		}
+		fmt.Fprintf(w, "%s%s %s\n", margin, arrow, group[0].Span.Start)
+
+		source, err := readFile(filename)
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(source), "\n")
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Span.Start.Offset < group[j].Span.Start.Offset
+		})
+
+		fmt.Fprintf(w, "%s |\n", margin)
+		lastLine := 0
+		for _, label := range group {
+			start, end := label.Span.Start, label.Span.End
+			if start.Line < 1 || start.Line > len(lines) {
+				continue
+			}
+			line := []rune(strings.TrimRight(lines[start.Line-1], "\r"))
+			if lastLine != 0 && start.Line > lastLine+1 {
+				fmt.Fprintf(w, "...\n")
+			}
+			if start.Line != lastLine {
+				fmt.Fprintf(w, "%*d | %s\n", gutter, start.Line, string(line))
+				lastLine = start.Line
+			}
+
+			column := start.Column - 1
+			if column > len(line) {
+				column = len(line)
+			}
+			length := len(line) - column
+			if end.Line == start.Line {
+				length = end.Column - start.Column
+			}
+			if length < 1 {
+				length = 1
+			}
+
+			// Keep tabs from the source line, so that the underline lines up.
+			indent := []rune{}
+			for _, r := range line[:column] {
+				if r == '\t' {
+					indent = append(indent, '\t')
+				} else {
+					indent = append(indent, ' ')
+				}
+			}
+
+			marker := "^"
+			if label.Message != "" {
+				marker = "-"
+			}
+			underline := string(indent) + strings.Repeat(marker, length)
+			if label.Message != "" {
+				underline += " " + label.Message
+			}
+			fmt.Fprintf(w, "%s | %s\n", margin, underline)
+		}
+	}
+
+	if len(d.Notes) > 0 {
+		fmt.Fprintf(w, "%s |\n", margin)
+	}
+	for _, note := range d.Notes {
+		fmt.Fprintf(w, "%s = note: %s\n", margin, note)
+	}
+}
+
+// Diagnostics lists every problem found while compiling a program, in source
+// order. It is returned as the error from Parse.
+type Diagnostics []*Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := []string{}
+	for _, diag := range d {
+		messages = append(messages, diag.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Add records err as a problem at the given span. Errors that are already
+// diagnostics keep their own span, if they have one.
+func (d *Diagnostics) Add(span Span, err error) {
+	if errors.Is(err, errReported) {
+		return
+	}
+	diag, ok := err.(*Diagnostic)
+	if !ok {
+		diag = &Diagnostic{Severity: SeverityError, Message: err.Error()}
+	}
+	if diag.Span.IsZero() {
+		diag.Span = span
+	}
+	*d = append(*d, diag)
+}
+
+// trimSpans moves the end of each span back over any trailing whitespace,
+// which the parser includes when it looks ahead for more tokens.
+func (d Diagnostics) trimSpans(sources map[string]string) {
+	trim := func(span *Span) {
+		source, ok := sources[span.End.Filename]
+		if !ok || span.End.Offset > len(source) {
+			return
+		}
+		for span.End.Offset > span.Start.Offset && strings.ContainsRune(" \t", rune(source[span.End.Offset-1])) {
+			span.End.Offset--
+			span.End.Column--
+		}
+	}
+
+	for _, diag := range d {
+		trim(&diag.Span)
+		for i := range diag.Related {
+			trim(&diag.Related[i].Span)
+		}
+	}
+}
+
+func (d Diagnostics) Sort() {
+	sort.SliceStable(d, func(i, j int) bool {
+		a, b := d[i].Span.Start, d[j].Span.Start
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+}
@@ -0,0 +1,480 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files in examples/")
+
+// Programs that must fail to compile say so with a comment, for example:
+//
+//	// expect-error: attempted to read consumed variable
+//
+// Programs with several mistakes list one comment per diagnostic, in order.
+var expectErrorPattern = regexp.MustCompile(`(?m)^\s*// expect-error: (.*)$`)
+
+// Programs can also say which arguments to run them with, quoting any that
+// are empty or have spaces, and which exit status they should finish with:
+//
+//	// args: one "" "three four"
+//	// expect-exit: 1
+var (
+	argsPattern       = regexp.MustCompile(`(?m)^\s*// args: (.*)$`)
+	argPattern        = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|\S+`)
+	expectExitPattern = regexp.MustCompile(`(?m)^\s*// expect-exit: (\d+)$`)
+)
+
+// Programs that read stdin are given the contents of <module>_stdin.txt, and
+// those that write to stderr have it compared with <module>_stderr.txt.
+type example struct {
+	Module         string
+	GoldenFile     string
+	StdinFile      string
+	StderrFile     string
+	ExpectedErrors []string
+	Args           []string
+	ExitStatus     int
+}
+
+// findExamples lists every program in examples/ that has either a golden
+// output file or an expected error.
+func findExamples(t *testing.T) []example {
+	filenames, err := filepath.Glob("examples/*.ht")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	examples := []example{}
+	for _, filename := range filenames {
+		source, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		module := strings.TrimSuffix(filepath.Base(filename), ".ht")
+		ex := example{
+			Module:     module,
+			GoldenFile: filepath.Join("examples", module+"_output.txt"),
+			StdinFile:  filepath.Join("examples", module+"_stdin.txt"),
+			StderrFile: filepath.Join("examples", module+"_stderr.txt"),
+		}
+		for _, match := range expectErrorPattern.FindAllSubmatch(source, -1) {
+			ex.ExpectedErrors = append(ex.ExpectedErrors, strings.TrimSpace(string(match[1])))
+		}
+		if match := argsPattern.FindSubmatch(source); match != nil {
+			for _, arg := range argPattern.FindAllString(string(match[1]), -1) {
+				if strings.HasPrefix(arg, `"`) {
+					unquoted, err := strconv.Unquote(arg)
+					if err != nil {
+						t.Fatalf("%s: bad argument %s: %s", filename, arg, err)
+					}
+					arg = unquoted
+				}
+				ex.Args = append(ex.Args, arg)
+			}
+		}
+		if match := expectExitPattern.FindSubmatch(source); match != nil {
+			if ex.ExitStatus, err = strconv.Atoi(string(match[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(ex.GoldenFile); os.IsNotExist(err) && ex.ExpectedErrors == nil {
+			continue
+		}
+		examples = append(examples, ex)
+	}
+	return examples
+}
+
+// checkGolden compares what an example wrote to stdout with its golden file,
+// and what it wrote to stderr with its own, if it has one.
+func checkGolden(t *testing.T, ex example, stdout, stderr []byte) {
+	checkGoldenFile(t, ex, ex.GoldenFile, stdout)
+	if _, err := os.Stat(ex.StderrFile); err == nil || (*update && len(stderr) > 0) {
+		checkGoldenFile(t, ex, ex.StderrFile, stderr)
+	}
+}
+
+func checkGoldenFile(t *testing.T, ex example, filename string, actual []byte) {
+	if *update {
+		if err := ioutil.WriteFile(filename, actual, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("output of %s differs from %s\n--- got:\n%s\n--- want:\n%s",
+			ex.Module, filename, actual, expected)
+	}
+}
+
+// readStdin reads what to give an example on stdin, which is nothing unless
+// it has a file for it.
+func readStdin(t *testing.T, ex example) []byte {
+	contents, err := ioutil.ReadFile(ex.StdinFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func checkErrors(t *testing.T, ex example, err error) {
+	if err == nil {
+		t.Fatalf("expected errors %q, but %s compiled", ex.ExpectedErrors, ex.Module)
+	}
+
+	var diags Diagnostics
+	if !errors.As(err, &diags) {
+		diags = Diagnostics{{Message: err.Error()}}
+	}
+
+	if len(diags) != len(ex.ExpectedErrors) {
+		t.Fatalf("expected %d errors, got %d:\n%v", len(ex.ExpectedErrors), len(diags), diags)
+	}
+	for i, diag := range diags {
+		if !strings.Contains(diag.Error(), ex.ExpectedErrors[i]) {
+			t.Errorf("expected error %q, got %q", ex.ExpectedErrors[i], diag.Error())
+		}
+	}
+}
+
+func TestExamples(t *testing.T) {
+	for _, ex := range findExamples(t) {
+		ex := ex
+		t.Run(ex.Module, func(t *testing.T) {
+			_, err := Parse(ex.Module, SearchPath{"examples"})
+			if ex.ExpectedErrors != nil {
+				checkErrors(t, ex, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			stdin := bytes.NewReader(readStdin(t, ex))
+			status := 0
+			var exit *ExitError
+			if err := Interpret(ex.Module, SearchPath{"examples"}, ex.Args, stdin, &stdout, &stderr); errors.As(err, &exit) {
+				status = exit.Code
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != ex.ExitStatus {
+				t.Errorf("%s exited with status %d, want %d", ex.Module, status, ex.ExitStatus)
+			}
+			checkGolden(t, ex, stdout.Bytes(), stderr.Bytes())
+		})
+	}
+}
+
+// TestExamplesCompiled checks that the C backend agrees with the golden files,
+// when a C compiler is available. Sleeps use the simulated clock, so that the
+// examples run instantly and the same way every time, as in the interpreter.
+func TestExamplesCompiled(t *testing.T) {
+	testCompiled(t, func(toolchain *Toolchain) {})
+}
+
+// TestExamplesThreaded does the same with the multi-threaded runtime, which
+// must not change what any example prints. ThreadSanitizer checks for races
+// between the workers, when the compiler supports it.
+func TestExamplesThreaded(t *testing.T) {
+	testCompiled(t, func(toolchain *Toolchain) {
+		toolchain.Threads = true
+		if ok, err := toolchain.Supports("-fsanitize=thread", "-pthread"); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			toolchain.Sanitizers = []string{"thread"}
+		}
+	})
+}
+
+// TestExamplesSanitized does the same with AddressSanitizer and
+// UndefinedBehaviorSanitizer, when the compiler supports them, to catch
+// generated code that touches states after they're freed.
+func TestExamplesSanitized(t *testing.T) {
+	testCompiled(t, func(toolchain *Toolchain) {
+		sanitizers := []string{"address", "undefined"}
+		if ok, err := toolchain.Supports("-fsanitize=" + strings.Join(sanitizers, ",")); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Skipf("%s doesn't support %s", toolchain.Compiler, strings.Join(sanitizers, ", "))
+		}
+		toolchain.Sanitizers = sanitizers
+	})
+}
+
+func testCompiled(t *testing.T, configure func(toolchain *Toolchain)) {
+	if testing.Short() {
+		t.Skip("skipping C compilation in short mode")
+	}
+	if *update {
+		t.Skip("golden files are regenerated by TestExamples")
+	}
+
+	toolchain, err := FindToolchain()
+	if err != nil {
+		t.Skip(err)
+	}
+	toolchain.VirtualClock = true
+	configure(toolchain)
+
+	dir, err := ioutil.TempDir("", "unique_effect_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ex := range findExamples(t) {
+		ex := ex
+		if ex.ExpectedErrors != nil {
+			continue
+		}
+
+		t.Run(ex.Module, func(t *testing.T) {
+			sources, err := Parse(ex.Module, SearchPath{"examples"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			executable := filepath.Join(dir, ex.Module)
+			if err := toolchain.Build(sources, ex.Module, executable); err != nil {
+				t.Fatal(err)
+			}
+
+			// Values on branches that aren't taken are never freed, so only
+			// memory errors fail the sanitized build, not leaks. Threaded
+			// builds get several workers even on a single CPU.
+			var stderr bytes.Buffer
+			cmd := exec.Command(executable, ex.Args...)
+			cmd.Env = append(os.Environ(), "ASAN_OPTIONS=detect_leaks=0", "UBSAN_OPTIONS=halt_on_error=1",
+				"UNIQUE_EFFECT_THREADS=4")
+			cmd.Stdin = bytes.NewReader(readStdin(t, ex))
+			cmd.Stderr = &stderr
+			output, err := cmd.Output()
+			status := 0
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				status = exit.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != ex.ExitStatus {
+				t.Fatalf("%s exited with status %d, want %d\n%s", ex.Module, status, ex.ExitStatus, stderr.Bytes())
+			}
+			checkGolden(t, ex, output, stderr.Bytes())
+		})
+	}
+}
+
+// TestTrace checks that a traced build writes valid trace JSON, in which
+// every call and timer that begins also ends, even in functions that return
+// early with ?.
+func TestTrace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping C compilation in short mode")
+	}
+
+	toolchain, err := FindToolchain()
+	if err != nil {
+		t.Skip(err)
+	}
+	toolchain.VirtualClock = true
+	toolchain.Trace = true
+
+	dir, err := ioutil.TempDir("", "unique_effect_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for module, categories := range map[string][]string{
+		"cancellation": {"call", "native", "timer", "cancel"},
+		"files":        {"call", "native"},
+	} {
+		module, categories := module, categories
+		t.Run(module, func(t *testing.T) {
+			sources, err := Parse(module, SearchPath{"examples"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			executable := filepath.Join(dir, module)
+			if err := toolchain.Build(sources, module, executable); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, module+".json")
+			cmd := exec.Command(executable)
+			cmd.Env = append(os.Environ(), "UNIQUE_EFFECT_TRACE="+path)
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			checkTrace(t, path, categories)
+		})
+	}
+}
+
+func checkTrace(t *testing.T, path string, categories []string) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []struct {
+			Phase    string `json:"ph"`
+			Category string `json:"cat"`
+			Name     string `json:"name"`
+			ID       string `json:"id"`
+		}
+	}
+	if err := json.Unmarshal(contents, &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	open := map[string]int{}
+	seen := map[string]bool{}
+	for _, event := range trace.TraceEvents {
+		seen[event.Category] = true
+		span := event.Category + " " + event.Name + " " + event.ID
+		switch event.Phase {
+		case "b", "B":
+			open[span]++
+		case "e", "E":
+			open[span]--
+		}
+	}
+	for span, count := range open {
+		if count != 0 {
+			t.Errorf("%s began %d more times than it ended", span, count)
+		}
+	}
+	for _, category := range categories {
+		if !seen[category] {
+			t.Errorf("no %s events in trace", category)
+		}
+	}
+}
+
+// TestGraph checks that every example can be drawn, and that variable names
+// label the edges that carry them.
+func TestGraph(t *testing.T) {
+	for _, ex := range findExamples(t) {
+		if ex.ExpectedErrors != nil {
+			continue
+		}
+		if _, err := Graph(ex.Module, SearchPath{"examples"}); err != nil {
+			t.Errorf("%s: %s", ex.Module, err)
+		}
+	}
+
+	dot, err := Graph("parallel", SearchPath{"examples"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`subgraph "cluster_main" {`,
+		`"main/arg0" [label="console", shape=invhouse];`,
+		`"main/2" [label="count()"];`,
+		`"main/2" -> "main/13" [label="a"];`,
+		`"main/18" -> "main/19" [label="console"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("graph is missing %s:\n%s", want, dot)
+		}
+	}
+}
+
+// TestAnalyze checks the critical paths and parallel widths of a few
+// examples, and that every example can be analyzed.
+func TestAnalyze(t *testing.T) {
+	for _, ex := range findExamples(t) {
+		if ex.ExpectedErrors != nil {
+			continue
+		}
+		if _, err := Analyze(ex.Module, SearchPath{"examples"}); err != nil {
+			t.Errorf("%s: %s", ex.Module, err)
+		}
+	}
+
+	for module, wants := range map[string][]string{
+		// The slower sleep is cancelled, so it isn't on the critical path.
+		"cancellation": {"critical path: 4.0s, 4 calls\n", "    sleep() (4.0s)\n"},
+		"hello": {
+			"critical path: 3.0s, 2 calls\n",
+			"    clock (Clock), through 2 calls; fork it",
+		},
+		"parallel": {"parallel width: 4 calls\n"},
+		"loops":    {"critical path: at least 1.0s"},
+	} {
+		report, err := Analyze(module, SearchPath{"examples"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(report, want) {
+				t.Errorf("analysis of %s is missing %q:\n%s", module, want, report)
+			}
+		}
+	}
+}
+
+// TestAnalyzeOrder checks that no statement the analysis visits waits for a
+// statement generated after it, in all of the examples. Registers joined
+// where branches merge are provided by both sides, but neither side provides
+// them to the other.
+func TestAnalyzeOrder(t *testing.T) {
+	for _, ex := range findExamples(t) {
+		if ex.ExpectedErrors != nil {
+			continue
+		}
+		program, err := loadProgram(ex.Module, SearchPath{"examples"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range program.GeneratedFunctions {
+			if g.IsNative {
+				continue
+			}
+			preds, _ := dependencies(g)
+			for _, edges := range preds {
+				for _, edge := range edges {
+					if edge.From >= edge.To {
+						t.Errorf("%s: %s: statement %d (%s) waits for statement %d (%s), which comes after it",
+							ex.Module, g.Name, edge.To, describeStatement(g.Conditions[edge.To].Statement),
+							edge.From, describeStatement(g.Conditions[edge.From].Statement))
+					}
+				}
+			}
+		}
+	}
+}
@@ -15,6 +15,9 @@
  */
 
 #include <assert.h>
+#include <ctype.h>
+#include <errno.h>
+#include <fcntl.h>
 #include <stdbool.h>
 #include <stdint.h>
 #include <stdio.h>
@@ -32,25 +35,297 @@ val_t kSingletonStream = (void *)40;
 val_t kSingletonClock = (void *)50;
 val_t kSingletonFileSystem = (void *)60;
 val_t kSingletonFileSystemWillFail = (void *)70;
+val_t kSingletonEnvironment = (void *)80;
+val_t kSingletonStdout = (void *)90;
+val_t kSingletonStderr = (void *)100;
+val_t kSingletonStdin = (void *)110;
+
+#ifdef USE_THREADS
+static __thread struct unique_effect_worker *current_worker;
+static __thread void *current_state;
+
+static size_t hash_state(void *state) {
+  return ((uintptr_t)state >> 4) * 2654435761u;
+}
+
+// find_status finds the status of the call to state, or the empty slot where
+// it belongs.
+static struct unique_effect_call_status *
+find_status(struct unique_effect_runtime *rt, void *state) {
+  size_t mask = rt->status_capacity - 1;
+  size_t i = hash_state(state) & mask;
+  while (rt->statuses[i].status != 0 && rt->statuses[i].state != state) {
+    i = (i + 1) & mask;
+  }
+  return &rt->statuses[i];
+}
+
+static void grow_statuses(struct unique_effect_runtime *rt) {
+  struct unique_effect_call_status *old = rt->statuses;
+  int old_capacity = rt->status_capacity;
+
+  rt->status_capacity = old_capacity > 0 ? 2 * old_capacity : 64;
+  rt->statuses = calloc(rt->status_capacity, sizeof(*rt->statuses));
+  for (int i = 0; i < old_capacity; i++) {
+    if (old[i].status != 0) {
+      *find_status(rt, old[i].state) = old[i];
+    }
+  }
+  free(old);
+}
+
+// remove_status empties slot, and moves back any of the entries after it that
+// could no longer be found otherwise.
+static void remove_status(struct unique_effect_runtime *rt,
+                          struct unique_effect_call_status *slot) {
+  size_t mask = rt->status_capacity - 1;
+  size_t hole = slot - rt->statuses;
+  for (size_t i = (hole + 1) & mask; rt->statuses[i].status != 0;
+       i = (i + 1) & mask) {
+    size_t home = hash_state(rt->statuses[i].state) & mask;
+    bool reachable = hole <= i ? (hole < home && home <= i)
+                               : (hole < home || home <= i);
+    if (!reachable) {
+      rt->statuses[hole] = rt->statuses[i];
+      hole = i;
+    }
+  }
+  rt->statuses[hole].status = 0;
+  rt->status_count--;
+}
+
+static void push_call(struct unique_effect_worker *w, closure_t call) {
+  if (w->count == w->capacity) {
+    int capacity = w->capacity > 0 ? 2 * w->capacity : 16;
+    closure_t *calls = malloc(sizeof(closure_t) * capacity);
+    for (int i = 0; i < w->count; i++) {
+      calls[i] = w->calls[(w->first + i) % w->capacity];
+    }
+    free(w->calls);
+    w->calls = calls;
+    w->first = 0;
+    w->capacity = capacity;
+  }
+  w->calls[(w->first + w->count) % w->capacity] = call;
+  w->count++;
+}
+
+// take_call finds the next call for w to run: the first of its own, or else
+// the last of another worker's.
+static bool take_call(struct unique_effect_runtime *rt,
+                      struct unique_effect_worker *w, closure_t *call) {
+  if (w->count > 0) {
+    *call = w->calls[w->first];
+    w->first = (w->first + 1) % w->capacity;
+    w->count--;
+    return true;
+  }
+
+  for (int i = 1; i < rt->worker_count; i++) {
+    struct unique_effect_worker *victim =
+        &rt->workers[(w - rt->workers + i) % rt->worker_count];
+    if (victim->count > 0) {
+      victim->count--;
+      *call = victim->calls[(victim->first + victim->count) % victim->capacity];
+      return true;
+    }
+  }
+  return false;
+}
+
+static bool has_calls(struct unique_effect_runtime *rt) {
+  for (int i = 0; i < rt->worker_count; i++) {
+    if (rt->workers[i].count > 0) {
+      return true;
+    }
+  }
+  return false;
+}
 
 void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
                                     closure_t closure) {
   assert(closure.func != NULL);
-  assert(rt->next_call < 100);
 
-  // Ignore duplicated calls to schedule the same function, as they can result
-  // in use-after-free bugs.
-  for (int i = rt->current_call; i < rt->next_call; i++) {
-    if (rt->upcoming_calls[i].state == closure.state) {
-      fprintf(stderr, "eliding duplicated call %p\n", closure.state);
-      return;
+  if (2 * (rt->status_count + 1) > rt->status_capacity) {
+    grow_statuses(rt);
+  }
+
+  // As without threads, duplicated calls are ignored, including a call
+  // scheduling itself. But a call that's scheduled by another worker while
+  // it's running (with the lock released) is run again, since it might have
+  // missed what changed.
+  struct unique_effect_call_status *slot = find_status(rt, closure.state);
+  if (slot->status == kCallQueued ||
+      (slot->status != 0 && closure.state == current_state)) {
+    fprintf(stderr, "eliding duplicated call %p\n", closure.state);
+    return;
+  } else if (slot->status != 0) {
+    slot->status = kCallRunningAgain;
+    return;
+  }
+
+  *slot = (struct unique_effect_call_status){closure.state, kCallQueued};
+  rt->status_count++;
+
+  // Calls from the main thread, such as timers, are shared out in turn.
+  struct unique_effect_worker *w = current_worker;
+  if (w == NULL) {
+    w = &rt->workers[rt->next_worker++ % rt->worker_count];
+  }
+  push_call(w, closure);
+  pthread_cond_signal(&rt->work_available);
+}
+
+static void *run_worker(void *arg) {
+  struct unique_effect_worker *w = arg;
+  struct unique_effect_runtime *rt = w->runtime;
+  current_worker = w;
+
+  pthread_mutex_lock(&rt->lock);
+  while (!rt->stopping) {
+    closure_t call;
+    if (!take_call(rt, w, &call)) {
+      pthread_cond_wait(&rt->work_available, &rt->lock);
+      continue;
+    }
+
+    find_status(rt, call.state)->status = kCallRunning;
+    rt->running_calls++;
+    current_state = call.state;
+    call.func(rt, call.state);
+    current_state = NULL;
+    rt->running_calls--;
+
+    struct unique_effect_call_status *slot = find_status(rt, call.state);
+    if (slot->status == kCallRunningAgain) {
+      slot->status = kCallQueued;
+      push_call(w, call);
+    } else {
+      remove_status(rt, slot);
     }
+
+    if (rt->running_calls == 0 && !has_calls(rt)) {
+      pthread_cond_broadcast(&rt->all_idle);
+    }
+  }
+  pthread_mutex_unlock(&rt->lock);
+  return NULL;
+}
+#else
+// find_scheduled finds where state is in the hash table of scheduled calls,
+// or the empty slot where it belongs.
+static struct unique_effect_scheduled *
+find_scheduled(struct unique_effect_runtime *rt, void *state) {
+  size_t mask = 2 * rt->call_capacity - 1;
+  size_t i = ((uintptr_t)state >> 4) * 2654435761u & mask;
+  while (rt->scheduled[i].generation == rt->generation &&
+         rt->scheduled[i].state != state) {
+    i = (i + 1) & mask;
+  }
+  return &rt->scheduled[i];
+}
+
+static void grow_queue(struct unique_effect_runtime *rt) {
+  rt->call_capacity = rt->call_capacity > 0 ? 2 * rt->call_capacity : 16;
+  rt->upcoming_calls =
+      realloc(rt->upcoming_calls, sizeof(closure_t) * rt->call_capacity);
+
+  free(rt->scheduled);
+  rt->scheduled = calloc(2 * rt->call_capacity, sizeof(*rt->scheduled));
+  for (int i = rt->current_call; i < rt->next_call; i++) {
+    *find_scheduled(rt, rt->upcoming_calls[i].state) =
+        (struct unique_effect_scheduled){
+            rt->upcoming_calls[i].state, i, rt->generation};
   }
+}
 
+void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
+                                    closure_t closure) {
+  assert(closure.func != NULL);
+
+  if (rt->next_call == rt->call_capacity) {
+    grow_queue(rt);
+  }
+
+  // Ignore duplicated calls to schedule the same function, as they can result
+  // in use-after-free bugs. This includes the call that's running now.
+  struct unique_effect_scheduled *slot = find_scheduled(rt, closure.state);
+  if (slot->generation == rt->generation && slot->index >= rt->current_call) {
+    fprintf(stderr, "eliding duplicated call %p\n", closure.state);
+    return;
+  }
+
+  *slot = (struct unique_effect_scheduled){closure.state, rt->next_call,
+                                           rt->generation};
   rt->upcoming_calls[rt->next_call] = closure;
   rt->next_call++;
 }
 
+#endif
+
+#ifndef USE_REAL_TIMERS
+static bool timer_before(struct unique_effect_sleep_state *a,
+                         struct unique_effect_sleep_state *b) {
+  if (a->trigger_time != b->trigger_time) {
+    return a->trigger_time < b->trigger_time;
+  }
+  return a->timer_sequence < b->timer_sequence;
+}
+
+static void place_timer(struct unique_effect_runtime *rt, int i,
+                        struct unique_effect_sleep_state *timer) {
+  rt->timers[i] = timer;
+  timer->timer_index = i;
+}
+
+// sift_timer moves the timer at i up or down the heap until it's in order.
+static void sift_timer(struct unique_effect_runtime *rt, int i) {
+  struct unique_effect_sleep_state *timer = rt->timers[i];
+  while (i > 0 && timer_before(timer, rt->timers[(i - 1) / 2])) {
+    place_timer(rt, i, rt->timers[(i - 1) / 2]);
+    i = (i - 1) / 2;
+  }
+  while (true) {
+    int child = 2 * i + 1;
+    if (child >= rt->timer_count) {
+      break;
+    }
+    if (child + 1 < rt->timer_count &&
+        timer_before(rt->timers[child + 1], rt->timers[child])) {
+      child++;
+    }
+    if (!timer_before(rt->timers[child], timer)) {
+      break;
+    }
+    place_timer(rt, i, rt->timers[child]);
+    i = child;
+  }
+  place_timer(rt, i, timer);
+}
+
+static void add_timer(struct unique_effect_runtime *rt,
+                      struct unique_effect_sleep_state *timer) {
+  if (rt->timer_count == rt->timer_capacity) {
+    rt->timer_capacity = 2 * rt->timer_capacity + 16;
+    rt->timers =
+        realloc(rt->timers, sizeof(*rt->timers) * rt->timer_capacity);
+  }
+  timer->timer_sequence = rt->started_timers++;
+  place_timer(rt, rt->timer_count++, timer);
+  sift_timer(rt, timer->timer_index);
+}
+
+static void remove_timer(struct unique_effect_runtime *rt,
+                         struct unique_effect_sleep_state *timer) {
+  int i = timer->timer_index;
+  rt->timer_count--;
+  if (i < rt->timer_count) {
+    place_timer(rt, i, rt->timers[rt->timer_count]);
+    sift_timer(rt, i);
+  }
+}
+#endif
+
 void unique_effect_print(struct unique_effect_runtime *rt, val_t console,
                          val_t msg, val_t *console_out) {
   assert(console == kSingletonStream);
@@ -58,19 +333,41 @@ void unique_effect_print(struct unique_effect_runtime *rt, val_t console,
   *console_out = console;
 }
 
+void unique_effect_println(struct unique_effect_runtime *rt, val_t out,
+                           val_t line, val_t *out_out) {
+  assert(out == kSingletonStdout);
+  printf("%s\n", (char *)line);
+  *out_out = out;
+}
+
+void unique_effect_eprintln(struct unique_effect_runtime *rt, val_t err,
+                            val_t line, val_t *err_out) {
+  assert(err == kSingletonStderr);
+  fprintf(stderr, "%s\n", (char *)line);
+  *err_out = err;
+}
+
+#ifndef USE_THREADS
 static void finish_current_iteration(struct unique_effect_runtime *rt) {
   for (; rt->current_call < rt->next_call; rt->current_call++) {
-    rt->upcoming_calls[rt->current_call].func(
-        rt, rt->upcoming_calls[rt->current_call].state);
+    // Calls can schedule more, which might move the queue.
+    closure_t call = rt->upcoming_calls[rt->current_call];
+    call.func(rt, call.state);
   }
+  rt->current_call = 0;
+  rt->next_call = 0;
+  rt->generation++;
 }
+#endif
 
-#ifdef USE_LIBUV
+#ifdef USE_REAL_TIMERS
 static void sleep_adapter_result(uv_timer_t *timer) {
   struct unique_effect_sleep_state *state = (struct unique_effect_sleep_state *)timer->data;
   struct unique_effect_runtime *runtime = state->runtime;
 
   runtime->current_time = state->trigger_time;
+  UNIQUE_EFFECT_TRACE(runtime, 'e', "timer", "sleep", state);
+  UNIQUE_EFFECT_TRACE(runtime, 'e', "call", "sleep", state);
 
   state->result[0]->value = kSingletonClock;
   state->result[0]->ready = true;
@@ -89,11 +386,17 @@ void unique_effect_sleep(struct unique_effect_runtime *rt,
     state->r[0].cancelled = true;
 
     // Cancel the pending timer.
-#ifdef USE_LIBUV
+#ifdef USE_REAL_TIMERS
     assert(uv_timer_stop(&state->timer) == 0);
 #else
-    *state->pending_timer = NULL;
+    if (state->conditions[0]) {
+      remove_timer(rt, state);
+    }
 #endif
+    if (state->conditions[0]) {
+      UNIQUE_EFFECT_TRACE(rt, 'e', "timer", "sleep", state);
+    }
+    UNIQUE_EFFECT_TRACE(rt, 'e', "call", "sleep", state);
 
     state->result[0]->value = kSingletonClock;
     state->result[0]->ready = true;
@@ -117,8 +420,9 @@ void unique_effect_sleep(struct unique_effect_runtime *rt,
 
   state->conditions[0] = true;
   state->trigger_time = rt->current_time + duration_in_seconds;
+  UNIQUE_EFFECT_TRACE(rt, 'b', "timer", "sleep", state);
 
-#ifdef USE_LIBUV
+#ifdef USE_REAL_TIMERS
   state->timer.data = state;
   state->runtime = rt;
 
@@ -126,17 +430,11 @@ void unique_effect_sleep(struct unique_effect_runtime *rt,
   uv_timer_start(&state->timer, &sleep_adapter_result, duration_in_seconds * 100, 0);
 #else
   assert(state->r[0].value == kSingletonClock);
-  assert(rt->next_timer < 20);
-
-  // Register the new timer in the runtime.
-  rt->timers[rt->next_timer] = state;
 
-  // Store an intermediate value in case we need to cancel this clock, and wake
-  // up the caller to let them know about it.
-  state->pending_timer = &rt->timers[rt->next_timer];
+  // Register the new timer in the runtime, and wake up the caller in case it
+  // needs to cancel this clock.
+  add_timer(rt, state);
   unique_effect_runtime_schedule(rt, state->caller);
-
-  rt->next_timer++;
 #endif
 }
 
@@ -150,7 +448,27 @@ void unique_effect_ReadLine(struct unique_effect_runtime *rt, val_t console,
 void unique_effect_itoa(struct unique_effect_runtime *rt, val_t int_val,
                         val_t *string_out) {
   *string_out = malloc(32);
-  snprintf(*string_out, 31, "%lu", (intptr_t)int_val);
+  snprintf(*string_out, 31, "%ld", (long)(intptr_t)int_val);
+}
+
+val_t unique_effect_divide(val_t a, val_t b) {
+  intptr_t x = (intptr_t)a, y = (intptr_t)b;
+  if (y == 0) {
+    return (val_t)0;
+  } else if (y == -1) {
+    return (val_t)(0 - (uintptr_t)x); // INTPTR_MIN / -1 overflows
+  }
+  return (val_t)(x / y);
+}
+
+val_t unique_effect_remainder(val_t a, val_t b) {
+  intptr_t x = (intptr_t)a, y = (intptr_t)b;
+  if (y == 0) {
+    return a;
+  } else if (y == -1) {
+    return (val_t)0;
+  }
+  return (val_t)(x % y);
 }
 
 void unique_effect_concat(struct unique_effect_runtime *rt, val_t a, val_t b,
@@ -165,19 +483,61 @@ void unique_effect_concat(struct unique_effect_runtime *rt, val_t a, val_t b,
 
 void unique_effect_exit(struct unique_effect_runtime *rt, void *state) {
   // All timers must have been fired or cancelled.
-  for (int i = 0; i < rt->next_timer; i++) {
-    assert(rt->timers[i] == NULL);
-  }
+  assert(rt->timer_count == 0);
 
+#ifndef USE_THREADS
   assert(rt->next_call == rt->current_call + 1);
+#endif
   rt->called_exit = true;
 }
 
+// The arguments given to main leave out the name of the program.
+val_t unique_effect_make_args(int argc, const char *argv[]) {
+  int length = argc > 1 ? argc - 1 : 0;
+  struct unique_effect_array *args =
+      malloc(sizeof(struct unique_effect_array) + sizeof(val_t) * length);
+  args->length = length;
+  args->capacity = length;
+  for (int i = 0; i < length; i++) {
+    args->elements[i] = strdup(argv[i + 1]);
+  }
+  return args;
+}
+
+int unique_effect_report_error(val_t err) {
+  fprintf(stderr, "error: %s\n", err != NULL ? (char *)err : "some error");
+  free(err);
+  return 1;
+}
+
+void unique_effect_function_free(val_t value) {
+  struct unique_effect_function *fn = (struct unique_effect_function *)value;
+  for (int i = 0; i < fn->count; i++) {
+    if (fn->captured[i].free != NULL) {
+      fn->captured[i].free(fn->captured[i].value);
+    }
+  }
+  free(fn);
+}
+
 void unique_effect_len(struct unique_effect_runtime *rt, val_t message,
                        val_t *result) {
   *result = (void *)(intptr_t)strlen((char *)message);
 }
 
+void unique_effect_primes(struct unique_effect_runtime *rt, val_t start,
+                          val_t end, val_t *result) {
+  intptr_t count = 0;
+  for (intptr_t n = (intptr_t)start; n < (intptr_t)end; n++) {
+    bool prime = n >= 2;
+    for (intptr_t d = 2; d * d <= n && prime; d++) {
+      prime = n % d != 0;
+    }
+    count += prime;
+  }
+  *result = (val_t)count;
+}
+
 void unique_effect_fork(struct unique_effect_runtime *rt, val_t parent,
                         val_t *a_out, val_t *b_out) {
   assert(parent == kSingletonClock);
@@ -217,6 +577,7 @@ void unique_effect_first(struct unique_effect_runtime *runtime,
   state->result[1]->value = kSingletonClock;
   state->result[1]->ready = true;
 
+  UNIQUE_EFFECT_TRACE(runtime, 'e', "call", "first", state);
   unique_effect_runtime_schedule(runtime, state->caller);
   free(state);
 }
@@ -231,13 +592,65 @@ void unique_effect_append(struct unique_effect_runtime *rt,
                           struct unique_effect_array **ary_out) {
   if (ary->length == ary->capacity) {
     ary = realloc(ary, sizeof(struct unique_effect_array) +
-                           sizeof(val_t) * ary->capacity * 2 + 1);
+                           sizeof(val_t) * (ary->capacity * 2 + 1));
     ary->capacity = 2 * ary->capacity + 1;
   }
   ary->elements[ary->length++] = value;
   *ary_out = ary;
 }
 
+// Out of range indices stop the program, since there's no element to return.
+static void check_index(struct unique_effect_array *ary, val_t index,
+                        int limit) {
+  if ((intptr_t)index < 0 || (intptr_t)index > limit) {
+    fprintf(stderr, "index %ld out of range for array of length %d\n",
+            (intptr_t)index, ary->length);
+    exit(1);
+  }
+}
+
+void unique_effect_length(struct unique_effect_runtime *rt,
+                          struct unique_effect_array *ary, val_t *result) {
+  *result = (val_t)(intptr_t)ary->length;
+}
+
+void unique_effect_get(struct unique_effect_runtime *rt,
+                       struct unique_effect_array *ary, val_t index,
+                       struct unique_effect_array **ary_out, val_t *elem_out) {
+  check_index(ary, index, ary->length - 1);
+  *elem_out = ary->elements[(intptr_t)index];
+  *ary_out = ary;
+}
+
+void unique_effect_take(struct unique_effect_runtime *rt,
+                        struct unique_effect_array *ary, val_t index,
+                        struct unique_effect_array **ary_out, val_t *elem_out) {
+  check_index(ary, index, ary->length - 1);
+  intptr_t i = (intptr_t)index;
+  *elem_out = ary->elements[i];
+  memmove(&ary->elements[i], &ary->elements[i + 1],
+          sizeof(val_t) * (ary->length - i - 1));
+  ary->length--;
+  *ary_out = ary;
+}
+
+void unique_effect_put(struct unique_effect_runtime *rt,
+                       struct unique_effect_array *ary, val_t index,
+                       val_t value, struct unique_effect_array **ary_out) {
+  check_index(ary, index, ary->length);
+  if (ary->length == ary->capacity) {
+    ary = realloc(ary, sizeof(struct unique_effect_array) +
+                           sizeof(val_t) * (ary->capacity * 2 + 1));
+    ary->capacity = 2 * ary->capacity + 1;
+  }
+  intptr_t i = (intptr_t)index;
+  memmove(&ary->elements[i + 1], &ary->elements[i],
+          sizeof(val_t) * (ary->length - i));
+  ary->elements[i] = value;
+  ary->length++;
+  *ary_out = ary;
+}
+
 void unique_effect_debug(struct unique_effect_runtime *rt,
                          struct unique_effect_array *ary, val_t *result_out) {
   char *result = malloc(512);
@@ -271,62 +684,661 @@ void unique_effect_mightfail(struct unique_effect_runtime *rt, val_t fs,
   }
 }
 
+// Errors hold their message, except for the ones made by mightfail.
 void unique_effect_reason(struct unique_effect_runtime *rt, val_t err,
                           val_t *reason) {
-  *reason = strdup("some error");
+  *reason = err != NULL ? err : strdup("some error");
+}
+
+static val_t make_union(intptr_t tag, val_t value) {
+  val_t *tagged = malloc(sizeof(val_t) * 2);
+  tagged[0] = (val_t)tag;
+  tagged[1] = value;
+  return tagged;
+}
+
+void unique_effect_getenv(struct unique_effect_runtime *rt, val_t env,
+                          val_t name, val_t *env_out, val_t *result) {
+  assert(env == kSingletonEnvironment);
+  *env_out = env;
+
+  const char *value = getenv(name);
+  if (value != NULL) {
+    *result = make_union(0, strdup(value));
+    return;
+  }
+
+  const char *message = "getenv %s: not set";
+  char *err = malloc(strlen(message) + strlen(name) + 1);
+  sprintf(err, message, (char *)name);
+  *result = make_union(1, err);
+}
+
+// file_error makes the Error for an operation on path that failed, as in
+// "open missing.txt: no such file or directory". The message is lower-cased,
+// since strerror capitalizes the messages that libuv doesn't.
+static val_t file_error(const char *op, const char *path, const char *message) {
+  size_t prefix = strlen(op) + strlen(path) + 3;
+  char *result = malloc(prefix + strlen(message) + 1);
+  sprintf(result, "%s %s: %s", op, path, message);
+  result[prefix] = tolower(result[prefix]);
+  return make_union(1, result);
+}
+
+// open_flags finds the flags for opening a file in the given mode, which is
+// "r", "w" or "a".
+static bool open_flags(const char *mode, int *flags) {
+  if (strcmp(mode, "r") == 0) {
+    *flags = O_RDONLY;
+  } else if (strcmp(mode, "w") == 0) {
+    *flags = O_WRONLY | O_CREAT | O_TRUNC;
+  } else if (strcmp(mode, "a") == 0) {
+    *flags = O_WRONLY | O_CREAT | O_APPEND;
+  } else {
+    return false;
+  }
+  return true;
+}
+
+// finish_file_call gives the results of a file operation back to its caller.
+static void finish_file_call(struct unique_effect_runtime *rt,
+                             future_t **result, val_t handle, val_t outcome,
+                             closure_t caller) {
+  result[0]->value = handle;
+  result[0]->ready = true;
+  result[1]->value = outcome;
+  result[1]->ready = true;
+  unique_effect_runtime_schedule(rt, caller);
+}
+
+#ifdef USE_LIBUV
+static void open_done(uv_fs_t *req) {
+  struct unique_effect_open_state *state = req->data;
+  struct unique_effect_runtime *rt = state->runtime;
+  const char *path = state->r[1].value;
+
+  val_t outcome;
+  if (req->result < 0) {
+    outcome = file_error("open", path, uv_strerror(req->result));
+  } else {
+    struct unique_effect_file *file = malloc(sizeof(*file));
+    file->path = strdup(path);
+    file->fd = req->result;
+    outcome = make_union(0, file);
+  }
+
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "open", state);
+  finish_file_call(rt, state->result, state->r[0].value, outcome,
+                   state->caller);
+  uv_fs_req_cleanup(req);
+  free(state);
+
+  finish_current_iteration(rt);
+}
+#endif
+
+void unique_effect_open(struct unique_effect_runtime *rt,
+                        struct unique_effect_open_state *state) {
+  if (!state->r[0].ready || !state->r[1].ready || !state->r[2].ready) {
+    return;
+  }
+
+  // Make sure that repeated calls are ignored, emulating a user function.
+  if (state->conditions[0]) {
+    return;
+  }
+  state->conditions[0] = true;
+
+  const char *path = state->r[1].value, *mode = state->r[2].value;
+  int flags;
+  if (!open_flags(mode, &flags)) {
+    char *message = malloc(strlen(mode) + 16);
+    sprintf(message, "invalid mode \"%s\"", mode);
+    UNIQUE_EFFECT_TRACE(rt, 'e', "call", "open", state);
+    finish_file_call(rt, state->result, state->r[0].value,
+                     file_error("open", path, message), state->caller);
+    free(message);
+    free(state);
+    return;
+  }
+
+#ifdef USE_LIBUV
+  state->runtime = rt;
+  state->req.data = state;
+  uv_fs_open(uv_default_loop(), &state->req, path, flags, 0666, &open_done);
+#else
+  val_t outcome;
+  FILE *fp = fopen(path, mode);
+  if (fp == NULL) {
+    outcome = file_error("open", path, strerror(errno));
+  } else {
+    struct unique_effect_file *file = malloc(sizeof(*file));
+    file->path = strdup(path);
+    file->fp = fp;
+    outcome = make_union(0, file);
+  }
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "open", state);
+  finish_file_call(rt, state->result, state->r[0].value, outcome,
+                   state->caller);
+  free(state);
+#endif
+}
+
+#ifdef USE_LIBUV
+static void read_done(uv_fs_t *req);
+
+// Files are read in chunks, until there's nothing left.
+static void read_next(struct unique_effect_read_state *state) {
+  struct unique_effect_file *file = state->r[0].value;
+  state->data = realloc(state->data, state->length + 4096 + 1);
+  state->buf = uv_buf_init(&state->data[state->length], 4096);
+  state->req.data = state;
+  uv_fs_read(uv_default_loop(), &state->req, file->fd, &state->buf, 1, -1,
+             &read_done);
+}
+
+static void read_done(uv_fs_t *req) {
+  struct unique_effect_read_state *state = req->data;
+  struct unique_effect_runtime *rt = state->runtime;
+  struct unique_effect_file *file = state->r[0].value;
+  ssize_t n = req->result;
+  uv_fs_req_cleanup(req);
+
+  if (n > 0) {
+    state->length += n;
+    read_next(state);
+    return;
+  }
+
+  val_t outcome;
+  if (n < 0) {
+    free(state->data);
+    outcome = file_error("read", file->path, uv_strerror(n));
+  } else {
+    state->data[state->length] = '\0';
+    outcome = make_union(0, state->data);
+  }
+
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "read", state);
+  finish_file_call(rt, state->result, file, outcome, state->caller);
+  free(state);
+
+  finish_current_iteration(rt);
+}
+#endif
+
+void unique_effect_read(struct unique_effect_runtime *rt,
+                        struct unique_effect_read_state *state) {
+  if (!state->r[0].ready || state->conditions[0]) {
+    return;
+  }
+  state->conditions[0] = true;
+
+#ifdef USE_LIBUV
+  state->runtime = rt;
+  state->data = NULL;
+  state->length = 0;
+  read_next(state);
+#else
+  struct unique_effect_file *file = state->r[0].value;
+  size_t length = 0, capacity = 4096;
+  char *data = malloc(capacity);
+  size_t n;
+  while ((n = fread(&data[length], 1, capacity - length, file->fp)) > 0) {
+    length += n;
+    if (length == capacity) {
+      capacity *= 2;
+      data = realloc(data, capacity);
+    }
+  }
+
+  val_t outcome;
+  if (ferror(file->fp)) {
+    free(data);
+    outcome = file_error("read", file->path, strerror(errno));
+    clearerr(file->fp);
+  } else {
+    data[length] = '\0';
+    outcome = make_union(0, data);
+  }
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "read", state);
+  finish_file_call(rt, state->result, file, outcome, state->caller);
+  free(state);
+#endif
+}
+
+#ifdef USE_LIBUV
+static void write_done(uv_fs_t *req);
+
+// Writes can be partial, so carry on from wherever the last one stopped.
+static void write_next(struct unique_effect_write_state *state) {
+  struct unique_effect_file *file = state->r[0].value;
+  char *data = state->r[1].value;
+  uv_buf_t buf =
+      uv_buf_init(&data[state->written], strlen(data) - state->written);
+  state->req.data = state;
+  uv_fs_write(uv_default_loop(), &state->req, file->fd, &buf, 1, -1,
+              &write_done);
+}
+
+static void write_done(uv_fs_t *req) {
+  struct unique_effect_write_state *state = req->data;
+  struct unique_effect_runtime *rt = state->runtime;
+  struct unique_effect_file *file = state->r[0].value;
+  ssize_t n = req->result;
+  uv_fs_req_cleanup(req);
+
+  if (n > 0) {
+    state->written += n;
+    if (state->written < strlen(state->r[1].value)) {
+      write_next(state);
+      return;
+    }
+  }
+
+  val_t outcome;
+  if (n < 0) {
+    outcome = file_error("write", file->path, uv_strerror(n));
+  } else {
+    outcome = make_union(0, (val_t)(intptr_t)state->written);
+  }
+
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "write", state);
+  finish_file_call(rt, state->result, file, outcome, state->caller);
+  free(state);
+
+  finish_current_iteration(rt);
+}
+#endif
+
+void unique_effect_write(struct unique_effect_runtime *rt,
+                         struct unique_effect_write_state *state) {
+  if (!state->r[0].ready || !state->r[1].ready || state->conditions[0]) {
+    return;
+  }
+  state->conditions[0] = true;
+
+#ifdef USE_LIBUV
+  state->runtime = rt;
+  state->written = 0;
+  write_next(state);
+#else
+  struct unique_effect_file *file = state->r[0].value;
+  const char *data = state->r[1].value;
+  size_t length = strlen(data);
+
+  // Flush straight away, so that errors are reported by the write that
+  // caused them.
+  val_t outcome;
+  if (fwrite(data, 1, length, file->fp) < length || fflush(file->fp) != 0) {
+    outcome = file_error("write", file->path, strerror(errno));
+    clearerr(file->fp);
+  } else {
+    outcome = make_union(0, (val_t)(intptr_t)length);
+  }
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "write", state);
+  finish_file_call(rt, state->result, file, outcome, state->caller);
+  free(state);
+#endif
+}
+
+#ifdef USE_LIBUV
+static void close_done(uv_fs_t *req) {
+  struct unique_effect_close_state *state = req->data;
+  struct unique_effect_runtime *rt = state->runtime;
+  struct unique_effect_file *file = state->r[1].value;
+
+  val_t outcome;
+  if (req->result < 0) {
+    outcome = file_error("close", file->path, uv_strerror(req->result));
+  } else {
+    outcome = make_union(0, (val_t)(intptr_t) true);
+  }
+
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "close", state);
+  finish_file_call(rt, state->result, state->r[0].value, outcome,
+                   state->caller);
+  uv_fs_req_cleanup(req);
+  free(file->path);
+  free(file);
+  free(state);
+
+  finish_current_iteration(rt);
+}
+#endif
+
+void unique_effect_close(struct unique_effect_runtime *rt,
+                         struct unique_effect_close_state *state) {
+  if (!state->r[0].ready || !state->r[1].ready || state->conditions[0]) {
+    return;
+  }
+  state->conditions[0] = true;
+
+  struct unique_effect_file *file = state->r[1].value;
+#ifdef USE_LIBUV
+  state->runtime = rt;
+  state->req.data = state;
+  uv_fs_close(uv_default_loop(), &state->req, file->fd, &close_done);
+#else
+  val_t outcome;
+  if (fclose(file->fp) != 0) {
+    outcome = file_error("close", file->path, strerror(errno));
+  } else {
+    outcome = make_union(0, (val_t)(intptr_t) true);
+  }
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "close", state);
+  finish_file_call(rt, state->result, state->r[0].value, outcome,
+                   state->caller);
+  free(file->path);
+  free(file);
+  free(state);
+#endif
+}
+
+// Lines are read from stdin without the trailing newline, and the last line
+// doesn't need one. Reading after the end gives an Error.
+static val_t end_of_input(void) {
+  return make_union(1, strdup("readln: end of input"));
+}
+
+#ifdef USE_LIBUV
+// Reads from stdin can go past the end of the line, so the rest is kept for
+// the next call to readln.
+static char *stdin_buffer;
+static size_t stdin_length;
+
+static void readln_done(uv_fs_t *req);
+
+// take_line moves the first line out of stdin_buffer, if it has a whole one,
+// or everything that's left if at_end.
+static char *take_line(bool at_end) {
+  char *newline = memchr(stdin_buffer, '\n', stdin_length);
+  if (newline == NULL && !(at_end && stdin_length > 0)) {
+    return NULL;
+  }
+
+  size_t length = newline != NULL ? newline - stdin_buffer : stdin_length;
+  size_t consumed = newline != NULL ? length + 1 : length;
+  char *line = malloc(length + 1);
+  memcpy(line, stdin_buffer, length);
+  line[length] = '\0';
+  memmove(stdin_buffer, &stdin_buffer[consumed], stdin_length - consumed);
+  stdin_length -= consumed;
+  return line;
+}
+
+static void readln_next(struct unique_effect_readln_state *state) {
+  char *line = take_line(false);
+  if (line != NULL) {
+    UNIQUE_EFFECT_TRACE(state->runtime, 'e', "call", "readln", state);
+    finish_file_call(state->runtime, state->result, state->r[0].value,
+                     make_union(0, line), state->caller);
+    free(state);
+    return;
+  }
+
+  stdin_buffer = realloc(stdin_buffer, stdin_length + 4096);
+  state->buf = uv_buf_init(&stdin_buffer[stdin_length], 4096);
+  state->req.data = state;
+  uv_fs_read(uv_default_loop(), &state->req, 0, &state->buf, 1, -1,
+             &readln_done);
+}
+
+static void readln_done(uv_fs_t *req) {
+  struct unique_effect_readln_state *state = req->data;
+  struct unique_effect_runtime *rt = state->runtime;
+  ssize_t n = req->result;
+  uv_fs_req_cleanup(req);
+
+  if (n > 0) {
+    stdin_length += n;
+    readln_next(state);
+  } else {
+    char *line = take_line(true);
+    val_t outcome = line != NULL ? make_union(0, line) : end_of_input();
+    UNIQUE_EFFECT_TRACE(rt, 'e', "call", "readln", state);
+    finish_file_call(rt, state->result, state->r[0].value, outcome,
+                     state->caller);
+    free(state);
+  }
+
+  finish_current_iteration(rt);
+}
+#endif
+
+void unique_effect_readln(struct unique_effect_runtime *rt,
+                          struct unique_effect_readln_state *state) {
+  if (!state->r[0].ready || state->conditions[0]) {
+    return;
+  }
+  state->conditions[0] = true;
+  assert(state->r[0].value == kSingletonStdin);
+
+#ifdef USE_LIBUV
+  state->runtime = rt;
+  readln_next(state);
+#else
+  char *line = NULL;
+  size_t capacity = 0;
+  ssize_t n = getline(&line, &capacity, stdin);
+
+  val_t outcome;
+  if (n < 0) {
+    free(line);
+    outcome = end_of_input();
+  } else {
+    if (n > 0 && line[n - 1] == '\n') {
+      line[n - 1] = '\0';
+    }
+    outcome = make_union(0, line);
+  }
+  UNIQUE_EFFECT_TRACE(rt, 'e', "call", "readln", state);
+  finish_file_call(rt, state->result, state->r[0].value, outcome,
+                   state->caller);
+  free(state);
+#endif
 }
 
 void unique_effect_runtime_init(struct unique_effect_runtime *rt) {
+  rt->upcoming_calls = NULL;
+  rt->call_capacity = 0;
   rt->next_call = 0;
-  rt->next_timer = 0;
   rt->current_call = 0;
+  rt->scheduled = NULL;
+  rt->generation = 1;
+  rt->timers = NULL;
+  rt->timer_count = 0;
+  rt->timer_capacity = 0;
+  rt->started_timers = 0;
+  rt->called_exit = false;
   rt->current_time = 0.0;
+
+#ifdef USE_THREADS
+  // There's a worker for each processor, unless UNIQUE_EFFECT_THREADS says
+  // otherwise.
+  const char *threads = getenv("UNIQUE_EFFECT_THREADS");
+  rt->worker_count = threads != NULL ? atoi(threads)
+                                     : (int)sysconf(_SC_NPROCESSORS_ONLN);
+  if (rt->worker_count < 1) {
+    rt->worker_count = 1;
+  }
+  rt->workers = calloc(rt->worker_count, sizeof(struct unique_effect_worker));
+  for (int i = 0; i < rt->worker_count; i++) {
+    rt->workers[i].runtime = rt;
+  }
+  rt->next_worker = 0;
+  rt->running_calls = 0;
+  rt->stopping = false;
+  rt->statuses = NULL;
+  rt->status_count = 0;
+  rt->status_capacity = 0;
+  pthread_mutex_init(&rt->lock, NULL);
+  pthread_cond_init(&rt->work_available, NULL);
+  pthread_cond_init(&rt->all_idle, NULL);
+#endif
+
+#ifdef USE_TRACE
+  rt->trace_events = NULL;
+  rt->trace_count = 0;
+  rt->trace_capacity = 0;
+  clock_gettime(CLOCK_MONOTONIC, &rt->trace_start);
+#ifdef USE_THREADS
+  pthread_mutex_init(&rt->trace_lock, NULL);
+#endif
+#endif
+}
+
+void unique_effect_runtime_release(struct unique_effect_runtime *rt) {
+#ifdef USE_THREADS
+  pthread_mutex_unlock(&rt->lock);
+#endif
+}
+
+void unique_effect_runtime_acquire(struct unique_effect_runtime *rt) {
+#ifdef USE_THREADS
+  pthread_mutex_lock(&rt->lock);
+#endif
+}
+
+#ifdef USE_TRACE
+void unique_effect_trace(struct unique_effect_runtime *rt, char phase,
+                         const char *category, const char *name, void *id) {
+  struct timespec now;
+  clock_gettime(CLOCK_MONOTONIC, &now);
+
+#ifdef USE_THREADS
+  pthread_mutex_lock(&rt->trace_lock);
+#endif
+  if (rt->trace_count == rt->trace_capacity) {
+    rt->trace_capacity = 2 * rt->trace_capacity + 256;
+    rt->trace_events = realloc(rt->trace_events, sizeof(*rt->trace_events) *
+                                                     rt->trace_capacity);
+  }
+  struct unique_effect_trace_event *event = &rt->trace_events[rt->trace_count++];
+  event->phase = phase;
+  event->category = category;
+  event->name = name;
+  event->id = id;
+  event->timestamp = (now.tv_sec - rt->trace_start.tv_sec) * 1e6 +
+                     (now.tv_nsec - rt->trace_start.tv_nsec) / 1e3;
+  event->clock = rt->current_time;
+#ifdef USE_THREADS
+  // Workers are numbered from 1, leaving 0 for the main thread.
+  event->thread = current_worker != NULL ? current_worker - rt->workers + 1 : 0;
+  pthread_mutex_unlock(&rt->trace_lock);
+#else
+  event->thread = 0;
+#endif
+}
+
+// write_trace writes every recorded event as JSON, which Perfetto and
+// chrome://tracing can open.
+static void write_trace(struct unique_effect_runtime *rt) {
+  const char *path = getenv("UNIQUE_EFFECT_TRACE");
+  if (path == NULL || *path == '\0') {
+    path = "trace.json";
+  }
+  FILE *fp = fopen(path, "w");
+  if (fp == NULL) {
+    fprintf(stderr, "trace %s: %s\n", path, strerror(errno));
+  } else {
+    fprintf(fp, "{\"traceEvents\":[\n");
+    for (int i = 0; i < rt->trace_count; i++) {
+      struct unique_effect_trace_event *event = &rt->trace_events[i];
+      fprintf(fp,
+              "{\"ph\":\"%c\",\"cat\":\"%s\",\"name\":\"%s\",\"ts\":%.3f,"
+              "\"pid\":1,\"tid\":%d,\"args\":{\"clock\":%.1f}",
+              event->phase, event->category, event->name, event->timestamp,
+              event->thread, event->clock);
+      if (event->phase == 'b' || event->phase == 'e') {
+        fprintf(fp, ",\"id\":\"%p\"", event->id);
+      } else if (event->phase == 'i') {
+        fprintf(fp, ",\"s\":\"t\"");
+      }
+      fprintf(fp, "}%s\n", i + 1 < rt->trace_count ? "," : "");
+    }
+    fprintf(fp, "],\"displayTimeUnit\":\"ms\"}\n");
+    fclose(fp);
+  }
+  free(rt->trace_events);
+}
+#endif
+
+#ifndef USE_REAL_TIMERS
+// fire_next_timers wakes up every sleep that triggers next, in the order they
+// started.
+static void fire_next_timers(struct unique_effect_runtime *runtime) {
+  runtime->current_time = runtime->timers[0]->trigger_time;
+  while (runtime->timer_count > 0 &&
+         runtime->timers[0]->trigger_time == runtime->current_time) {
+    struct unique_effect_sleep_state *timer = runtime->timers[0];
+    remove_timer(runtime, timer);
+    UNIQUE_EFFECT_TRACE(runtime, 'e', "timer", "sleep", timer);
+    UNIQUE_EFFECT_TRACE(runtime, 'e', "call", "sleep", timer);
+    unique_effect_runtime_schedule(runtime, timer->caller);
+    timer->result[0]->value = kSingletonClock;
+    timer->result[0]->ready = true;
+    free(timer);
+  }
 }
+#endif
 
 void unique_effect_runtime_loop(struct unique_effect_runtime *runtime) {
-#ifdef USE_LIBUV
+#if defined(USE_LIBUV)
   finish_current_iteration(runtime);
 
   uv_run(uv_default_loop(), UV_RUN_DEFAULT);
+#ifndef USE_REAL_TIMERS
+  // Only move the clock on once there's no I/O left to wait for.
+  while (runtime->timer_count > 0) {
+    fire_next_timers(runtime);
+    finish_current_iteration(runtime);
+    uv_run(uv_default_loop(), UV_RUN_DEFAULT);
+  }
+#endif
   uv_loop_close(uv_default_loop());
-#else
+#elif defined(USE_THREADS)
+  for (int i = 0; i < runtime->worker_count; i++) {
+    pthread_create(&runtime->workers[i].thread, NULL, &run_worker,
+                   &runtime->workers[i]);
+  }
+
+  // Timers only fire once every worker has run out of calls, as they do
+  // without threads.
+  pthread_mutex_lock(&runtime->lock);
   while (true) {
-    finish_current_iteration(runtime);
-    if (runtime->next_timer > 0) {
-      double next_trigger_time = -1;
-      // Look for the next timer event.
-      for (int i = 0; i < runtime->next_timer; i++) {
-        if (runtime->timers[i] != NULL &&
-            (next_trigger_time < 0 ||
-             runtime->timers[i]->trigger_time < next_trigger_time)) {
-          next_trigger_time = runtime->timers[i]->trigger_time;
-        }
-      }
-      for (int i = 0; i < runtime->next_timer; i++) {
-        if (runtime->timers[i] == NULL ||
-            runtime->timers[i]->trigger_time > next_trigger_time) {
-          // timer has been cancelled or hasn't fired yet
-          continue;
-        }
-        unique_effect_runtime_schedule(runtime, runtime->timers[i]->caller);
-        runtime->timers[i]->result[0]->value = kSingletonClock;
-        runtime->timers[i]->result[0]->ready = true;
-        free(runtime->timers[i]);
-        runtime->timers[i] = NULL;
-      }
-      if (next_trigger_time >= 0) {
-        runtime->current_time = next_trigger_time;
-      } else {
-        // There's nothing left to do, so free up all the completed slots
-        // currently in the runtime.
-        runtime->next_timer = 0;
-      }
-    } else {
+    while (runtime->running_calls > 0 || has_calls(runtime)) {
+      pthread_cond_wait(&runtime->all_idle, &runtime->lock);
+    }
+    if (runtime->timer_count == 0) {
       break;
     }
+    fire_next_timers(runtime);
+  }
+  runtime->stopping = true;
+  pthread_cond_broadcast(&runtime->work_available);
+  pthread_mutex_unlock(&runtime->lock);
+
+  for (int i = 0; i < runtime->worker_count; i++) {
+    pthread_join(runtime->workers[i].thread, NULL);
+    free(runtime->workers[i].calls);
+  }
+  free(runtime->workers);
+  free(runtime->statuses);
+#else
+  finish_current_iteration(runtime);
+  while (runtime->timer_count > 0) {
+    fire_next_timers(runtime);
+    finish_current_iteration(runtime);
   }
 #endif
 
+  free(runtime->upcoming_calls);
+  free(runtime->scheduled);
+  free(runtime->timers);
+#ifdef USE_TRACE
+  write_trace(runtime);
+#endif
   printf("finished after %0.1fs\n", runtime->current_time);
   assert(runtime->called_exit);
 }
@@ -18,11 +18,31 @@
 #define __BUILTINS_H__
 
 #include <stdbool.h>
+#include <stdio.h>
 
 #ifdef USE_LIBUV
 #include <uv.h>
 #endif
 
+// Sleeps take real time under libuv. Otherwise, or with USE_VIRTUAL_CLOCK,
+// the clock is simulated: once there's nothing left to run, it jumps straight
+// to the next timer, so programs that sleep finish instantly and always
+// behave the same way.
+#if defined(USE_LIBUV) && !defined(USE_VIRTUAL_CLOCK)
+#define USE_REAL_TIMERS
+#endif
+
+#ifdef USE_THREADS
+#ifdef USE_LIBUV
+#error "USE_THREADS can't be combined with USE_LIBUV"
+#endif
+#include <pthread.h>
+#endif
+
+#ifdef USE_TRACE
+#include <time.h>
+#endif
+
 typedef void *val_t;
 typedef struct {
   val_t value;
@@ -36,30 +56,128 @@ typedef struct {
   func_t func;
 } closure_t;
 
+// Where a call was last put in the queue, so that scheduling the same call
+// twice can be spotted without searching the queue. Entries from before the
+// queue was last emptied have an older generation, and are ignored.
+struct unique_effect_scheduled {
+  void *state;
+  int index;
+  int generation;
+};
+
 struct unique_effect_runtime {
-  closure_t upcoming_calls[100];
+  // Calls waiting to run, in the order that they were scheduled. The queue
+  // grows as needed, and starts again from the beginning once it's empty.
+  closure_t *upcoming_calls;
+  int call_capacity;
   int next_call;
   int current_call;
 
-  // Compatibility mode (in case libuv is unavailable).
-  struct unique_effect_sleep_state *timers[20];
-  int next_timer;
+  // A hash table of the calls in the queue, with twice its capacity.
+  struct unique_effect_scheduled *scheduled;
+  int generation;
+
+  // With the simulated clock, pending sleeps are kept in a binary heap,
+  // ordered by when they trigger and then by when they started.
+  struct unique_effect_sleep_state **timers;
+  int timer_count;
+  int timer_capacity;
+  long started_timers;
 
   bool called_exit;
   double current_time;
+
+#ifdef USE_THREADS
+  // Calls run on a pool of workers, each with its own queue, and workers
+  // that run out of calls steal them from the others. Generated code runs
+  // while holding lock, which protects every future_t, the conditions and
+  // child calls of each state, and the runtime itself. It's only released
+  // around calls to sync native functions, which is where calls on
+  // different workers overlap.
+  pthread_mutex_t lock;
+  pthread_cond_t work_available;
+  pthread_cond_t all_idle;
+  struct unique_effect_worker *workers;
+  int worker_count;
+  int next_worker;
+  int running_calls;
+  bool stopping;
+
+  // What each scheduled call is doing, so that a call that's scheduled
+  // again while it runs is run once more afterwards, rather than twice at
+  // the same time. This is a hash table keyed by state, with a power of two
+  // capacity.
+  struct unique_effect_call_status *statuses;
+  int status_count;
+  int status_capacity;
+#endif
+
+#ifdef USE_TRACE
+  // Events recorded so far, which are written out as a trace once the
+  // program finishes. Timestamps are relative to trace_start.
+  struct unique_effect_trace_event *trace_events;
+  int trace_count;
+  int trace_capacity;
+  struct timespec trace_start;
+#ifdef USE_THREADS
+  // Sync native functions record events without holding lock.
+  pthread_mutex_t trace_lock;
+#endif
+#endif
+};
+
+#ifdef USE_TRACE
+// An event in Chrome's trace event format. Async calls and timers begin ('b')
+// and end ('e') on their own tracks, matched up by category and id, while
+// native functions begin ('B') and end ('E') on the thread that runs them,
+// and cancellations are instant ('i').
+struct unique_effect_trace_event {
+  char phase;
+  const char *category;
+  const char *name;
+  void *id;
+  double timestamp;
+  double clock;
+  int thread;
+};
+#endif
+
+#ifdef USE_THREADS
+struct unique_effect_worker {
+  struct unique_effect_runtime *runtime;
+  pthread_t thread;
+
+  // A ring buffer of calls: the worker takes them from the front, and other
+  // workers steal from the back.
+  closure_t *calls;
+  int first, count, capacity;
 };
 
+enum unique_effect_call_state {
+  kCallQueued = 1,
+  kCallRunning,
+  kCallRunningAgain,
+};
+
+struct unique_effect_call_status {
+  void *state;
+  enum unique_effect_call_state status;
+};
+#endif
+
 struct unique_effect_sleep_state {
   future_t r[2];
   future_t *result[1];
   closure_t caller;
 
-#ifdef USE_LIBUV
+#ifdef USE_REAL_TIMERS
   // Needed to get back into the event loop.
   struct unique_effect_runtime *runtime;
   uv_timer_t timer;
 #else
-  struct unique_effect_sleep_state** pending_timer;
+  // Where the timer is in the runtime's heap, and the order it started in.
+  int timer_index;
+  long timer_sequence;
 #endif
   double trigger_time;
 
@@ -73,20 +191,152 @@ struct unique_effect_first_state {
   bool conditions[1]; // needed for calling convention
 };
 
+// An open file. The path is kept for error messages.
+struct unique_effect_file {
+  char *path;
+#ifdef USE_LIBUV
+  uv_file fd;
+#else
+  FILE *fp;
+#endif
+};
+
+// The file operations wait for their arguments, and then finish in a single
+// step without libuv. Under libuv, the request runs on libuv's thread pool,
+// and calls back into the runtime once it is done.
+struct unique_effect_open_state {
+  future_t r[3];
+  future_t *result[2];
+  closure_t caller;
+
+#ifdef USE_LIBUV
+  struct unique_effect_runtime *runtime;
+  uv_fs_t req;
+#endif
+
+  bool conditions[1]; // needed for calling convention
+};
+
+struct unique_effect_read_state {
+  future_t r[1];
+  future_t *result[2];
+  closure_t caller;
+
+#ifdef USE_LIBUV
+  struct unique_effect_runtime *runtime;
+  uv_fs_t req;
+  uv_buf_t buf;
+  char *data;
+  size_t length;
+#endif
+
+  bool conditions[1]; // needed for calling convention
+};
+
+struct unique_effect_write_state {
+  future_t r[2];
+  future_t *result[2];
+  closure_t caller;
+
+#ifdef USE_LIBUV
+  struct unique_effect_runtime *runtime;
+  uv_fs_t req;
+  size_t written;
+#endif
+
+  bool conditions[1]; // needed for calling convention
+};
+
+struct unique_effect_close_state {
+  future_t r[2];
+  future_t *result[2];
+  closure_t caller;
+
+#ifdef USE_LIBUV
+  struct unique_effect_runtime *runtime;
+  uv_fs_t req;
+#endif
+
+  bool conditions[1]; // needed for calling convention
+};
+
+struct unique_effect_readln_state {
+  future_t r[1];
+  future_t *result[2];
+  closure_t caller;
+
+#ifdef USE_LIBUV
+  struct unique_effect_runtime *runtime;
+  uv_fs_t req;
+  uv_buf_t buf;
+#endif
+
+  bool conditions[1]; // needed for calling convention
+};
+
 struct unique_effect_array {
   int length;
   int capacity;
   val_t elements[];
 };
 
+// A value captured by a lambda. Values that are owned by the function are
+// deleted with free when the function is.
+struct unique_effect_capture {
+  val_t value;
+  void (*free)(val_t value);
+};
+
+// A function value: start calls the function, passing captured values after
+// args, and schedules caller once all of the results are ready.
+struct unique_effect_function {
+  void (*start)(struct unique_effect_runtime *rt,
+                struct unique_effect_function *fn, val_t *args,
+                future_t **results, closure_t caller);
+  int count;
+  struct unique_effect_capture captured[];
+};
+
 extern val_t kSingletonStream;
 extern val_t kSingletonClock;
 extern val_t kSingletonFileSystem;
+extern val_t kSingletonEnvironment;
+extern val_t kSingletonStdout;
+extern val_t kSingletonStderr;
+extern val_t kSingletonStdin;
 
 void unique_effect_runtime_init(struct unique_effect_runtime *rt);
+
+// Generated code calls these around each sync native function, letting other
+// workers run while it does. They do nothing without USE_THREADS.
+void unique_effect_runtime_release(struct unique_effect_runtime *rt);
+void unique_effect_runtime_acquire(struct unique_effect_runtime *rt);
 void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
                                     closure_t closure);
 void unique_effect_runtime_loop(struct unique_effect_runtime *rt);
+
+// With USE_TRACE, UNIQUE_EFFECT_TRACE records an event, and the runtime
+// writes them all to $UNIQUE_EFFECT_TRACE (or trace.json) at the end. It
+// does nothing otherwise.
+#ifdef USE_TRACE
+void unique_effect_trace(struct unique_effect_runtime *rt, char phase,
+                         const char *category, const char *name, void *id);
+#define UNIQUE_EFFECT_TRACE(rt, phase, category, name, id)                     \
+  unique_effect_trace(rt, phase, category, name, id)
+#else
+#define UNIQUE_EFFECT_TRACE(rt, phase, category, name, id) ((void)0)
+#endif
 void unique_effect_exit(struct unique_effect_runtime *rt, void *state);
 
+// Helpers for main, which make its command-line arguments, and report the
+// Error that it returned before failing.
+val_t unique_effect_make_args(int argc, const char *argv[]);
+int unique_effect_report_error(val_t err);
+void unique_effect_function_free(val_t fn);
+
+// Integer division and remainder, defined for every input: dividing by zero
+// gives zero (leaving the dividend as the remainder), and overflow wraps.
+val_t unique_effect_divide(val_t a, val_t b);
+val_t unique_effect_remainder(val_t a, val_t b);
+
 #endif
@@ -16,8 +16,9 @@ package unique_effect
 
 import (
 	"fmt"
-	"github.com/alecthomas/participle/v2/lexer"
 	"io"
+	"sort"
+	"strings"
 )
 
 type stmtWithCondition struct {
@@ -25,22 +26,61 @@ type stmtWithCondition struct {
 	Statement generatedStatement
 }
 
+// explodedStruct records a struct variable that has been split into one local
+// per field (named "variable.field"), because a field was moved out of it.
+type explodedStruct struct {
+	Kind   *Kind
+	Fields []string
+}
+
 type generator struct {
 	Name           string
 	Conditions     []stmtWithCondition
 	Locals         map[string]register
-	ConsumedLocals map[string]*lexer.Position
+	ConsumedLocals map[string]Span
 	Results        int
 	Registers      []*Kind
 	IsNative       bool
+	IsSynchronous  bool
 	ArgKinds       []*Kind
 	ReturnKind     []*Kind
 	Substitutions  map[register]register
 	ChildCalls     []string
 	NextClosure    int
+	Diagnostics    *Diagnostics
+	Poisoned       map[string]bool
+	Exploded       map[string]explodedStruct
+	TypeArgs       map[string]*Kind
+
+	// IsFunctionValue is set when the function is used as a value, so that it
+	// needs a start function that can call it. The last Captured arguments
+	// are the values captured by a lambda, rather than its parameters.
+	IsFunctionValue bool
+	Captured        int
+
+	// KeptAlive maps registers lent to a call to the registers that hold
+	// their values once the call has finished.
+	KeptAlive map[register]register
+
+	// Loop is the loop whose body is being generated, if any, which break
+	// and continue statements leave. Terminated is set once the statements
+	// being generated have returned, broken out of the loop or continued it,
+	// so that nothing after them can run.
+	Loop       *loop
+	Terminated bool
 
 	CurrentCondition condition
 	NextCondition    condition
+
+	// Names records the variable that each register was first bound to, so
+	// that the dataflow graph can say what flows along each edge.
+	Names map[register]variable
+}
+
+// variable is a named local, and its type when it was bound.
+type variable struct {
+	Name string
+	Kind *Kind
 }
 
 func newGenerator(name string, program *program, argNames []string, argKinds []*Kind, results []*Kind) *generator {
@@ -48,7 +88,12 @@ func newGenerator(name string, program *program, argNames []string, argKinds []*
 	function.Name = name
 	function.Substitutions = map[register]register{}
 	function.Locals = map[string]register{}
-	function.ConsumedLocals = map[string]*lexer.Position{}
+	function.ConsumedLocals = map[string]Span{}
+	function.Diagnostics = &program.Diagnostics
+	function.Poisoned = map[string]bool{}
+	function.Exploded = map[string]explodedStruct{}
+	function.KeptAlive = map[register]register{}
+	function.Names = map[register]variable{}
 	function.ArgKinds = argKinds
 	function.ReturnKind = results
 	function.Results = len(results)
@@ -60,6 +105,7 @@ func newGenerator(name string, program *program, argNames []string, argKinds []*
 		function.Registers = append(function.Registers, argKinds[i])
 		function.Locals[arg] = register(i)
 	}
+	function.NameLocals()
 
 	program.GeneratedFunctions = append(program.GeneratedFunctions, function)
 	return function
@@ -95,6 +141,22 @@ func (g *generator) JoinRegisters(a, b register) {
 	}
 }
 
+// NameLocals remembers the names of any variables bound to registers that
+// haven't been named yet.
+func (g *generator) NameLocals() {
+	names := make([]string, 0, len(g.Locals))
+	for name := range g.Locals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		reg := g.Locals[name]
+		if _, ok := g.Names[reg]; !ok {
+			g.Names[reg] = variable{name, g.Registers[reg]}
+		}
+	}
+}
+
 func (g *generator) Stmt(s generatedStatement) {
 	g.StmtWithCond(g.CurrentCondition, s)
 }
@@ -117,6 +179,119 @@ func (g *generator) CopyOfLocals() map[string]register {
 	return result
 }
 
+// A branch is where one side of a conditional left off: the variables it
+// defined, the types of the registers, and whether it terminated.
+type branch struct {
+	Condition  condition
+	Locals     map[string]register
+	Registers  []*Kind
+	Terminated bool
+}
+
+// EndBranch finishes the side of a conditional that ran under cond. If the
+// side terminated, the registers from firstNew onwards, which it created, are
+// forgotten, since none of the code after the conditional can use them.
+func (g *generator) EndBranch(cond condition, firstNew int) branch {
+	if g.Terminated {
+		for i := firstNew; i < len(g.Registers); i++ {
+			g.Registers[i] = nil
+		}
+	}
+	end := branch{cond, g.Locals, make([]*Kind, len(g.Registers)), g.Terminated}
+	copy(end.Registers, g.Registers)
+	g.Terminated = false
+	return end
+}
+
+// MergeBranches joins the local variables at the end of two mutually
+// exclusive branches, so that later statements can use them whichever branch
+// ran. Variables that were defined before the branches, and survive both of
+// them, are kept; what names the construct being merged, for errors. If one
+// branch terminated, the variables come from the other one alone.
+func (g *generator) MergeBranches(what string, localsAtStart map[string]register, ifTrue, ifFalse branch) *Diagnostic {
+	if ifTrue.Terminated && ifFalse.Terminated {
+		g.Locals = localsAtStart
+		g.Terminated = true
+		return nil
+	} else if ifFalse.Terminated {
+		copy(g.Registers, ifTrue.Registers)
+		g.fallThrough(localsAtStart, ifTrue)
+		return nil
+	} else if ifTrue.Terminated {
+		g.fallThrough(localsAtStart, ifFalse)
+		return nil
+	}
+
+	localsAfterTrue, localsAfterFalse := ifTrue.Locals, ifFalse.Locals
+	g.Locals = map[string]register{}
+	for name := range localsAtStart {
+		regTrue, ok := localsAfterTrue[name]
+		if !ok {
+			continue
+		}
+
+		regFalse, ok := localsAfterFalse[name]
+		if !ok {
+			continue
+		}
+
+		// The false side may have consumed a variable that the true side
+		// left alone, so the true side's types are those from its end.
+		kindTrue, kindFalse := ifTrue.Registers[regTrue], g.Registers[regFalse]
+		if err := kindTrue.IsEquivalent(*kindFalse); err != nil {
+			return newError(CodeTypeMismatch, "%s has unequal types on both sides of %s: %s", name, what, err)
+		}
+
+		// If the variable is used on one side and not the other, make sure
+		// that both sides have a unique variable name, so that any future
+		// dependencies on this variable wait until the condition is resolved.
+		// The original register is moved into the new one.
+		if regTrue != regFalse {
+			if regTrue == localsAtStart[name] {
+				renamed := g.NewReg(kindTrue, true)
+				g.StmtWithCond(ifTrue.Condition, &genRenameRegister{regTrue, renamed})
+				g.Forget(g.ResolveRegister(regTrue))
+				regTrue = renamed
+			}
+
+			if regFalse == localsAtStart[name] {
+				renamed := g.NewReg(kindFalse, true)
+				g.StmtWithCond(ifFalse.Condition, &genRenameRegister{regFalse, renamed})
+				g.Forget(g.ResolveRegister(regFalse))
+				regFalse = renamed
+			}
+		}
+
+		g.JoinRegisters(regTrue, regFalse)
+		g.Locals[name] = regTrue
+	}
+	return nil
+}
+
+// fallThrough takes the variables from the only branch that didn't
+// terminate. Each one is moved into a new register under that branch's
+// condition, so that the statements after the conditional only run when the
+// branch did.
+func (g *generator) fallThrough(localsAtStart map[string]register, side branch) {
+	g.Locals = map[string]register{}
+	renamed := map[register]register{}
+	for name := range localsAtStart {
+		reg, ok := side.Locals[name]
+		if !ok {
+			continue
+		}
+		reg = g.ResolveRegister(reg)
+		if _, ok := renamed[reg]; !ok {
+			renamed[reg] = g.NewReg(g.Registers[reg], true)
+			g.StmtWithCond(side.Condition, &genRenameRegister{reg, renamed[reg]})
+		}
+		g.Locals[name] = renamed[reg]
+	}
+	for reg := range renamed {
+		g.Forget(reg)
+	}
+}
+
 func (g *generator) GarbageRegisters(keep []register) (map[register]*Kind, error) {
 	keepMap := map[register]bool{}
 	for _, reg := range keep {
@@ -130,7 +305,14 @@ func (g *generator) GarbageRegisters(keep []register) (map[register]*Kind, error
 			if kind.CanBeImplicitlyDeleted() {
 				garbage[reg] = kind
 			} else {
-				return nil, fmt.Errorf("unused value of type %s (r%d)", kind, reg)
+				err := newError(CodeUnusedValue, "unused value of type %s (r%d)", kind, reg).
+					WithNote("values of type %s must be returned, or passed to a function that consumes them", kind)
+				for name, target := range g.Locals {
+					if g.ResolveRegister(target) == reg {
+						err.WithNote("the value is held in variable \"%s\"", name)
+					}
+				}
+				return nil, err
 			}
 		}
 	}
@@ -138,6 +320,9 @@ func (g *generator) GarbageRegisters(keep []register) (map[register]*Kind, error
 }
 
 func (g generator) TypeDefinition(w io.Writer) {
+	if g.IsFunctionValue {
+		fmt.Fprintf(w, "%s;\n", g.StartHeader())
+	}
 	if g.IsNative {
 		fmt.Fprintf(w, "void unique_effect_%s();\n", g.Name)
 		return
@@ -148,7 +333,12 @@ func (g generator) TypeDefinition(w io.Writer) {
 	fmt.Fprintf(w, "  closure_t caller;\n")
 	fmt.Fprintf(w, "  bool conditions[%d];\n", len(g.Conditions))
 	for index, kind := range g.ChildCalls {
-		fmt.Fprintf(w, "  struct unique_effect_%s_state *call_%d;\n", kind, index)
+		if kind == "" {
+			// Function values can call anything.
+			fmt.Fprintf(w, "  void *call_%d;\n", index)
+		} else {
+			fmt.Fprintf(w, "  struct unique_effect_%s_state *call_%d;\n", kind, index)
+		}
 		fmt.Fprintf(w, "  bool call_%d_done;\n", index)
 	}
 	fmt.Fprintf(w, "};\n")
@@ -253,44 +443,152 @@ func (g *generator) FormatInto(w io.Writer) {
 	fmt.Fprintf(w, "}\n")
 }
 
+// ExitStatus checks that main only takes and returns values that the
+// runtime knows how to make and consume, and finds the result that holds the
+// exit status of the program, or -1 if there isn't one.
+func (g *generator) ExitStatus() (int, error) {
+	for _, kind := range g.ArgKinds {
+		if !kind.CanBeArgumentToMain() {
+			return 0, fmt.Errorf("not sure how to synthesize a %s", *kind)
+		}
+	}
+
+	status := -1
+	for i, kind := range g.ReturnKind {
+		if !kind.CanBeReturnedFromMain() {
+			return 0, fmt.Errorf("not sure how to consume a %s", *kind)
+		}
+		if kind.IsExitStatus() {
+			if status >= 0 {
+				return 0, fmt.Errorf("main can only return one exit status, not %s and %s", *g.ReturnKind[status], *kind)
+			}
+			status = i
+		}
+	}
+	return status, nil
+}
+
 func (g *generator) FormatMainInto(w io.Writer) error {
+	status, err := g.ExitStatus()
+	if err != nil {
+		return err
+	}
+
 	fmt.Fprintf(w, "int main(int argc, const char* argv[]) {\n")
 	fmt.Fprintf(w, "  struct unique_effect_runtime rt;\n")
 	fmt.Fprintf(w, "  unique_effect_runtime_init(&rt);\n")
 	fmt.Fprintf(w, "  struct unique_effect_%[1]s_state *st = calloc(1, sizeof(struct unique_effect_%[1]s_state));\n", g.Name)
+	fmt.Fprintf(w, "  UNIQUE_EFFECT_TRACE(&rt, 'b', \"call\", \"%s\", st);\n", g.Name)
 
 	for i, kind := range g.ArgKinds {
-		if kind.CanBeArgumentToMain() {
-			fmt.Fprintf(w, "  st->r[%d].value = kSingleton%s;\n", i, kind.Family.String())
-			fmt.Fprintf(w, "  st->r[%d].ready = true;\n", i)
+		if kind.IsArgs() {
+			fmt.Fprintf(w, "  st->r[%d].value = unique_effect_make_args(argc, argv);\n", i)
 		} else {
-			return fmt.Errorf("not sure how to synthesize a %s", *kind)
+			fmt.Fprintf(w, "  st->r[%d].value = kSingleton%s;\n", i, kind.Family.String())
 		}
+		fmt.Fprintf(w, "  st->r[%d].ready = true;\n", i)
 	}
 
-	for i, kind := range g.ReturnKind {
-		if kind.CanBeReturnedFromMain() {
+	for i := range g.ReturnKind {
+		if i == status {
+			fmt.Fprintf(w, "  future_t exit_status;\n")
+			fmt.Fprintf(w, "  st->result[%d] = &exit_status;\n", i)
+		} else {
 			fmt.Fprintf(w, "  future_t dropped_result_%d;\n", i)
 			fmt.Fprintf(w, "  st->result[%[1]d] = &dropped_result_%[1]d;\n", i)
-		} else {
-			return fmt.Errorf("not sure how to consume a %s", *kind)
 		}
 	}
 
 	fmt.Fprintf(w, "  st->caller = (closure_t){.state = NULL, .func = &unique_effect_exit};\n")
 	fmt.Fprintf(w, "  unique_effect_runtime_schedule(&rt, (closure_t){.state = st, .func = &unique_effect_%s});\n", g.Name)
 	fmt.Fprintf(w, "  unique_effect_runtime_loop(&rt);\n")
+
+	switch {
+	case status < 0:
+		fmt.Fprintf(w, "  return 0;\n")
+	case g.ReturnKind[status].Family == FamilyInteger:
+		fmt.Fprintf(w, "  return (int)(intptr_t)exit_status.value;\n")
+	default:
+		// An Error is reported and fails the program, while an Integer is
+		// the exit status, and anything else succeeds.
+		fmt.Fprintf(w, "  val_t *tagged = exit_status.value;\n")
+		for i, member := range g.ReturnKind[status].UnpackAsUnion() {
+			if member.IsError() {
+				fmt.Fprintf(w, "  if (tagged[0] == (val_t)%d) return unique_effect_report_error(tagged[1]);\n", i)
+			} else if member.Family == FamilyInteger {
+				fmt.Fprintf(w, "  if (tagged[0] == (val_t)%d) return (int)(intptr_t)tagged[1];\n", i)
+			}
+		}
+		fmt.Fprintf(w, "  return 0;\n")
+	}
 	fmt.Fprintf(w, "}\n")
 	return nil
 }
 
+// FormatStartInto writes the start function for a function value, which
+// calls the function with the given arguments and the values captured by
+// the function value.
+func (g *generator) FormatStartInto(w io.Writer) {
+	params := len(g.ArgKinds) - g.Captured
+
+	fmt.Fprintf(w, "%s {\n", g.StartHeader())
+	if g.IsNative && g.IsSynchronous {
+		cArgs := []string{"rt"}
+		for i := 0; i < params; i++ {
+			cArgs = append(cArgs, fmt.Sprintf("args[%d]", i))
+		}
+		for i := 0; i < g.Results; i++ {
+			cArgs = append(cArgs, fmt.Sprintf("&results[%d]->value", i))
+		}
+		fmt.Fprintf(w, "  UNIQUE_EFFECT_TRACE(rt, 'B', \"native\", \"%s\", NULL);\n", g.Name)
+		fmt.Fprintf(w, "  unique_effect_%s(%s);\n", g.Name, strings.Join(cArgs, ", "))
+		fmt.Fprintf(w, "  UNIQUE_EFFECT_TRACE(rt, 'E', \"native\", \"%s\", NULL);\n", g.Name)
+		for i := 0; i < g.Results; i++ {
+			fmt.Fprintf(w, "  results[%d]->ready = true;\n", i)
+		}
+		fmt.Fprintf(w, "  unique_effect_runtime_schedule(rt, caller);\n")
+		fmt.Fprintf(w, "}\n")
+		return
+	}
+
+	fmt.Fprintf(w, "  struct unique_effect_%[1]s_state *st = calloc(1, sizeof(struct unique_effect_%[1]s_state));\n", g.Name)
+	fmt.Fprintf(w, "  UNIQUE_EFFECT_TRACE(rt, 'b', \"call\", \"%s\", st);\n", g.Name)
+	for i := 0; i < params; i++ {
+		fmt.Fprintf(w, "  st->r[%[1]d] = (future_t){.value = args[%[1]d], .ready = true};\n", i)
+	}
+	for i := 0; i < g.Captured; i++ {
+		fmt.Fprintf(w, "  st->r[%d] = (future_t){.value = fn->captured[%d].value, .ready = true};\n", params+i, i)
+	}
+	for i := 0; i < g.Results; i++ {
+		fmt.Fprintf(w, "  st->result[%[1]d] = results[%[1]d];\n", i)
+	}
+	fmt.Fprintf(w, "  st->caller = caller;\n")
+	fmt.Fprintf(w, "  unique_effect_runtime_schedule(rt, (closure_t){.state = st, .func = &unique_effect_%s});\n", g.Name)
+	fmt.Fprintf(w, "}\n")
+}
+
+func (g generator) StartHeader() string {
+	return fmt.Sprintf("void unique_effect_%s_start(struct unique_effect_runtime *rt, struct unique_effect_function *fn, val_t *args, future_t **results, closure_t caller)", g.Name)
+}
+
 func (g generator) Header() string {
 	return fmt.Sprintf("void unique_effect_%s(struct unique_effect_runtime *rt, struct unique_effect_%s_state *sp)", g.Name, g.Name)
 }
 
 func (g *generator) NewClosure(p *program, argNames []string, argKinds []*Kind, results []*Kind) *generator {
 	g.NextClosure += 1
-	return newGenerator(fmt.Sprintf("%s_%d", g.Name, g.NextClosure), p, argNames, argKinds, results)
+	closure := newGenerator(fmt.Sprintf("%s_%d", g.Name, g.NextClosure), p, argNames, argKinds, results)
+	for name := range g.Poisoned {
+		closure.Poisoned[name] = true
+	}
+	closure.TypeArgs = g.TypeArgs
+	return closure
+}
+
+// Report records a problem with the statement at the given span, so that
+// code generation can carry on and find any others.
+func (g *generator) Report(span Span, err error) {
+	g.Diagnostics.Add(span, err)
 }
 
 func (g *generator) NewCondition() condition {
@@ -311,22 +609,114 @@ func (g *generator) MaybeMakeTuple(registers []register) register {
 		for _, reg := range registers {
 			types = append(types, g.Registers[reg])
 		}
-		result := g.NewReg(&Kind{false, FamilyTuple, types, "Tuple"}, true)
+		result := g.NewReg(&Kind{false, FamilyTuple, types, "Tuple", nil, nil}, true)
 		g.Stmt(&genMakeTuple{Inputs: registers, Result: result})
 		return result
 	}
 }
 
-func (g *generator) Consume(reg register, position *lexer.Position) {
+// Lookup finds the register holding the named local variable, which is used
+// at the given span.
+func (g *generator) Lookup(name string, span Span) (register, error) {
+	if reg, ok := g.Locals[name]; ok {
+		return reg, nil
+	}
+	if g.Poisoned[name] {
+		return 0, errReported
+	}
+	if exploded, ok := g.Exploded[name]; ok {
+		return g.reassemble(name, exploded, span)
+	}
+	if consumed, ok := g.ConsumedLocals[name]; ok {
+		return 0, newError(CodeConsumedVariable, "attempted to read consumed variable \"%s\"", name).
+			At(span).
+			WithRelated(consumed, "\"%s\" was consumed here", name).
+			WithNote("passing &%s lends the variable to a function, rather than giving it away", name)
+	}
+	return 0, newError(CodeUnknownVariable, "unknown variable \"%s\"", name).At(span)
+}
+
+// reassemble puts an exploded struct back together from its fields, so that it
+// can be used as a whole again.
+func (g *generator) reassemble(name string, exploded explodedStruct, span Span) (register, error) {
+	fields := []register{}
+	for _, field := range exploded.Fields {
+		reg, err := g.Lookup(name+"."+field, span)
+		if diag, ok := err.(*Diagnostic); ok {
+			return 0, newError(diag.Code, "attempted to read \"%s\" after moving its field \"%s\"", name, field).
+				At(span).
+				WithRelated(g.ConsumedLocals[name+"."+field], "\"%s.%s\" was moved here", name, field).
+				WithNote("give %s.%s a new value with \"%s with {%s: ...}\"", name, field, name, field)
+		} else if err != nil {
+			return 0, err
+		}
+		fields = append(fields, reg)
+	}
+
+	result := g.NewReg(exploded.Kind, true)
+	g.Stmt(&genMakeTuple{Inputs: fields, Result: result})
+	for _, reg := range fields {
+		g.Consume(g.ResolveRegister(reg), span)
+	}
+	delete(g.Exploded, name)
+	delete(g.ConsumedLocals, name)
+	g.Locals[name] = result
+	return result, nil
+}
+
+// ReassembleAll puts back together every exploded struct whose fields are
+// all still present. This is done around branches and loops, which can only
+// merge variables that exist as a whole on every path.
+func (g *generator) ReassembleAll() {
+	for name, exploded := range g.Exploded {
+		if _, ok := g.Locals[name]; ok {
+			// The variable has since been given a new value.
+			delete(g.Exploded, name)
+		} else if _, ok := g.Exploded[name]; ok {
+			_, _ = g.reassemble(name, exploded, Span{})
+		}
+	}
+}
+
+// Latest follows a register that was lent to a call to the register holding
+// its value after the call.
+func (g *generator) Latest(reg register) register {
+	reg = g.ResolveRegister(reg)
+	for g.Registers[reg] == nil {
+		next, ok := g.KeptAlive[reg]
+		if !ok {
+			break
+		}
+		reg = g.ResolveRegister(next)
+	}
+	return reg
+}
+
+// IsLocal is whether the name refers to a local variable, even one that has
+// since been consumed, rather than to a function.
+func (g *generator) IsLocal(name string) bool {
+	_, local := g.Locals[name]
+	_, exploded := g.Exploded[name]
+	_, consumed := g.ConsumedLocals[name]
+	return local || exploded || consumed || g.Poisoned[name]
+}
+
+// Forget marks a register (and any registers joined with it) as no longer
+// holding a value, since it has been moved elsewhere.
+func (g *generator) Forget(reg register) {
 	for idx := range g.Registers {
 		if r := register(idx); g.ResolveRegister(r) == reg {
 			g.Registers[r] = nil
 		}
 	}
+}
+
+func (g *generator) Consume(reg register, span Span) {
+	g.Forget(reg)
 
 	for lcl, target := range g.Locals {
 		if g.ResolveRegister(target) == reg {
-			g.ConsumedLocals[lcl] = position
+			g.ConsumedLocals[lcl] = span
 			delete(g.Locals, lcl)
 		}
 	}
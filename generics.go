@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxInstances limits how many times a single generic function can be
+// instantiated, to catch functions that call themselves with ever larger
+// type arguments.
+const maxInstances = 100
+
+// sameKind reports whether two kinds are identical, including all of their
+// type arguments.
+func sameKind(a, b *Kind) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Family == b.Family && a.Label == b.Label && a.Borrowed == b.Borrowed &&
+		sameKinds(a.TupleOrUnionArgs, b.TupleOrUnionArgs) && sameKinds(a.TypeArgs, b.TypeArgs) &&
+		sameKinds(a.Results, b.Results)
+}
+
+func sameKinds(a, b []*Kind) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameKind(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// unify matches the type written for a parameter against the kind of the
+// value passed to it, binding any type parameters that it mentions.
+func unify(param *TypeRep, arg *Kind, params []string, bindings map[string]*Kind) error {
+	if arg == nil {
+		// For example, the elements of an empty array.
+		return nil
+	}
+
+	for _, name := range params {
+		if param.Name != name {
+			continue
+		}
+		owned := *arg
+		owned.Borrowed = false
+		if bound, ok := bindings[name]; ok && !sameKind(bound, &owned) {
+			return fmt.Errorf("type parameter %s can't be both %s and %s", name, bound, &owned)
+		}
+		bindings[name] = &owned
+		return nil
+	}
+
+	if param.Func != nil {
+		if arg.Family != FamilyFunction || len(param.Func.Params) != len(arg.TupleOrUnionArgs) || len(param.Func.Results) != len(arg.Results) {
+			return nil
+		}
+		for i, sub := range param.Func.Params {
+			if err := unify(sub, arg.TupleOrUnionArgs[i], params, bindings); err != nil {
+				return err
+			}
+		}
+		for i, sub := range param.Func.Results {
+			if err := unify(sub, arg.Results[i], params, bindings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Type arguments of generic structs are kept separately from the fields.
+	args := arg.TupleOrUnionArgs
+	if len(arg.TypeArgs) > 0 {
+		args = arg.TypeArgs
+	}
+	if param.Name != arg.Label || len(param.Args) != len(args) {
+		// The mismatch is reported when the argument is checked.
+		return nil
+	}
+	for i, sub := range param.Args {
+		if err := unify(sub, args[i], params, bindings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inferTypeArgs works out the type arguments of a call to a generic function
+// from the kinds of the values passed to it.
+func (a *astFunction) inferTypeArgs(args []*Kind) (map[string]*Kind, error) {
+	if len(a.TypeParams) == 0 {
+		return nil, nil
+	}
+
+	bindings := map[string]*Kind{}
+	for i, arg := range a.Args {
+		if err := unify(arg.Kind, args[i], a.TypeParams, bindings); err != nil {
+			return nil, &argumentError{i, err}
+		}
+	}
+
+	for _, name := range a.TypeParams {
+		if _, ok := bindings[name]; !ok {
+			return nil, newError(CodeTypeMismatch, "cannot infer type parameter %s of %s", name, a.Name).
+				WithRelated(newSpan(a.Pos, a.EndPos), "%s is defined here", a.Name).
+				WithNote("each type parameter must appear in the type of an argument")
+		}
+	}
+	return bindings, nil
+}
+
+var nonIdentifier = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// instantiate returns the name of the generated code for a function with the
+// given type arguments, generating it if this is the first such call. Native
+// functions are shared by every instantiation, since all values have the same
+// representation at run time.
+func (p *program) instantiate(a *astFunction, typeArgs map[string]*Kind) (string, error) {
+	if len(a.TypeParams) == 0 {
+		return a.Name, nil
+	}
+	if a.IsNative {
+		// Only the declaration is generated, and it doesn't mention types.
+		if _, ok := p.Instances[a.Name]; !ok {
+			p.Instances[a.Name] = a.Name
+			a.generate(p, a.Name, typeArgs)
+		}
+		return a.Name, nil
+	}
+
+	names := []string{}
+	for _, param := range a.TypeParams {
+		names = append(names, typeArgs[param].String())
+	}
+	key := fmt.Sprintf("%s[%s]", a.Name, strings.Join(names, ", "))
+	if name, ok := p.Instances[key]; ok {
+		return name, nil
+	}
+
+	count := 0
+	for existing := range p.Instances {
+		if strings.HasPrefix(existing, a.Name+"[") {
+			count++
+		}
+	}
+	if count >= maxInstances {
+		return "", newError(CodeUnsupported, "too many instantiations of %s", a.Name).
+			WithRelated(newSpan(a.Pos, a.EndPos), "%s is defined here", a.Name).
+			WithNote("%s may be calling itself with ever larger type arguments", a.Name)
+	}
+
+	name := a.Name + "__" + strings.Trim(nonIdentifier.ReplaceAllString(strings.Join(names, "_"), "_"), "_")
+	p.Instances[key] = name
+	a.generate(p, name, typeArgs)
+	return name, nil
+}
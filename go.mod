@@ -1,6 +1,6 @@
 module github.com/fatlotus/unique_effect
 
-go 1.15
+go 1.16
 
 require (
 	github.com/alecthomas/participle/v2 v2.0.0-alpha3
@@ -0,0 +1,219 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Graph compiles the given module, and describes the dataflow of each of its
+// functions as a Graphviz DOT graph. Statements that aren't connected by a
+// path can run in parallel.
+func Graph(main string, resolver Resolver) (string, error) {
+	program, err := loadProgram(main, resolver)
+	if err != nil {
+		return "", err
+	}
+
+	functions := []*generator{}
+	for _, gen := range program.GeneratedFunctions {
+		if !gen.IsNative {
+			functions = append(functions, gen)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+
+	result := strings.Builder{}
+	fmt.Fprintf(&result, "digraph %s {\n", dotQuote(main))
+	fmt.Fprintf(&result, "  node [shape=box];\n")
+	for _, gen := range functions {
+		gen.FormatGraphInto(&result)
+	}
+	fmt.Fprintf(&result, "}\n")
+	return result.String(), nil
+}
+
+// dataflowEdge carries a register from the statement that provides it to one
+// that needs it. Parameters are numbered -1, -2 and so on, since they're
+// provided before any statement runs.
+type dataflowEdge struct {
+	From, To int
+	Register register
+}
+
+// Dataflow lists the edges between the function's statements, in order of the
+// statements that need them, along with the name of each register that was
+// bound to a variable.
+func (g *generator) Dataflow() ([]dataflowEdge, map[register]variable) {
+	// Registers may have been merged since they were named.
+	names := map[register]variable{}
+	named := make([]register, 0, len(g.Names))
+	for reg := range g.Names {
+		named = append(named, reg)
+	}
+	sort.Slice(named, func(i, j int) bool { return named[i] < named[j] })
+	for _, reg := range named {
+		if _, ok := names[g.ResolveRegister(reg)]; !ok {
+			names[g.ResolveRegister(reg)] = g.Names[reg]
+		}
+	}
+
+	// Both sides of a branch may provide the same register.
+	sources := map[register][]int{}
+	for i := range g.ArgKinds {
+		reg := g.ResolveRegister(register(i))
+		sources[reg] = append(sources[reg], -1-i)
+	}
+	for i, stmt := range g.Conditions {
+		_, provides := stmt.Statement.Deps()
+		for _, reg := range provides {
+			reg = g.ResolveRegister(reg)
+			sources[reg] = append(sources[reg], i)
+		}
+	}
+
+	edges := []dataflowEdge{}
+	seen := map[dataflowEdge]bool{}
+	for i, stmt := range g.Conditions {
+		needs, _ := stmt.Statement.Deps()
+		if inputs, ok := stmt.Statement.(statementWithInputs); ok {
+			needs = append(needs, inputs.Inputs()...)
+		}
+		for _, reg := range needs {
+			reg = g.ResolveRegister(reg)
+			for _, source := range sources[reg] {
+				edge := dataflowEdge{source, i, reg}
+				if !seen[edge] {
+					seen[edge] = true
+					edges = append(edges, edge)
+				}
+			}
+		}
+	}
+	return edges, names
+}
+
+// FormatGraphInto writes a subgraph for the function, with a node for each
+// parameter and statement. Solid edges carry registers, labeled with the
+// variable they hold, and dashed edges lead from a branch to the statements
+// that only run when it goes a particular way.
+func (g *generator) FormatGraphInto(w io.Writer) {
+	node := func(i int) string {
+		if i < 0 {
+			return dotQuote(fmt.Sprintf("%s/arg%d", g.Name, -1-i))
+		}
+		return dotQuote(fmt.Sprintf("%s/%d", g.Name, i))
+	}
+
+	fmt.Fprintf(w, "  subgraph %s {\n", dotQuote("cluster_"+g.Name))
+	fmt.Fprintf(w, "    label=%s;\n", dotQuote(g.Name))
+
+	dataflow, names := g.Dataflow()
+	for i := range g.ArgKinds {
+		reg := g.ResolveRegister(register(i))
+		fmt.Fprintf(w, "    %s [label=%s, shape=invhouse];\n", node(-1-i), dotQuote(names[reg].Name))
+	}
+
+	// Which statement decides that each condition holds, and how.
+	type branch struct {
+		Source int
+		Label  string
+	}
+	branches := map[condition]branch{}
+	for i, stmt := range g.Conditions {
+		if _, ok := stmt.Statement.(*genComment); ok {
+			continue
+		}
+		fmt.Fprintf(w, "    %s [label=%s];\n", node(i), dotQuote(describeStatement(stmt.Statement)))
+
+		if stmt, ok := stmt.Statement.(statementWithBranches); ok {
+			for cond, label := range stmt.Branches() {
+				branches[cond] = branch{i, label}
+			}
+		}
+	}
+
+	edges := map[string]bool{}
+	for _, edge := range dataflow {
+		line := fmt.Sprintf("%s -> %s", node(edge.From), node(edge.To))
+		if name, ok := names[edge.Register]; ok {
+			line += fmt.Sprintf(" [label=%s]", dotQuote(name.Name))
+		}
+		edges[line] = true
+	}
+	for i, stmt := range g.Conditions {
+		if b, ok := branches[stmt.Cond]; ok {
+			edges[fmt.Sprintf("%s -> %s [style=dashed, label=%s]", node(b.Source), node(i), dotQuote(b.Label))] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(edges))
+	for edge := range edges {
+		sorted = append(sorted, edge)
+	}
+	sort.Strings(sorted)
+	for _, edge := range sorted {
+		fmt.Fprintf(w, "    %s;\n", edge)
+	}
+	fmt.Fprintf(w, "  }\n")
+}
+
+// describeStatement labels a statement in the graph.
+func describeStatement(stmt generatedStatement) string {
+	switch s := stmt.(type) {
+	case *genCallSyncFunction:
+		return s.Name + "()"
+	case *genCallAsyncFunction:
+		return s.Name + "()"
+	case *genCallFunctionValue:
+		return "call"
+	case *genRestartLoop:
+		return "next iteration"
+	case *genReturn:
+		return "return"
+	case *genBranch:
+		return "if"
+	case *genStringLiteral:
+		return strconv.Quote(s.Value)
+	case *genIntegerLiteral:
+		return strconv.FormatInt(s.Value, 10)
+	case *genIntegerComparison:
+		return s.Operation
+	case *genStringComparison:
+		return s.Operation
+	case *genIntegerArithmetic:
+		return s.Operation
+	case *genNot:
+		return "!"
+	case *genRenameRegister:
+		return "="
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", stmt), "*unique_effect.gen")
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// dotQuote quotes s as a DOT string.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,910 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The interpreter runs the generated dataflow program directly, instead of
+// going through C. It mirrors the C runtime in gen/builtins.c (in its
+// compatibility mode, without libuv), so that both produce the same output.
+//
+// Values are represented as follows:
+//
+//	Integer, Boolean     int64
+//	String               string
+//	Tuple, Array         []value
+//	Union                unionValue
+//	Error                errorValue
+//	File                 *os.File
+//	Stream, Clock, ...   singleton
+//	Function             *functionValue
+type value interface{}
+
+type singleton string
+
+// A functionValue is a function, along with the values captured by its body.
+type functionValue struct {
+	Name     string
+	Captured []value
+}
+
+type unionValue struct {
+	Tag   int
+	Value value
+}
+
+type errorValue string
+
+type future struct {
+	value            value
+	ready, cancelled bool
+}
+
+// A task is anything that can be passed to unique_effect_runtime_schedule.
+type task interface {
+	run(m *machine)
+}
+
+// A frame is the interpreted equivalent of a unique_effect_*_state struct.
+type frame struct {
+	function   *generator
+	native     nativeAsyncFunction
+	r          []future
+	result     []*future
+	caller     task
+	conditions []bool
+	calls      []*frame
+	callsDone  []bool
+	freed      bool
+
+	triggerTime float64
+	timerSlot   int
+}
+
+type exitTask struct{}
+
+type nativeSyncFunction func(m *machine, args []value) ([]value, error)
+type nativeAsyncFunction func(m *machine, f *frame)
+
+type machine struct {
+	functions map[string]*generator
+	stdout    io.Writer
+	stderr    io.Writer
+	stdin     *bufio.Reader
+
+	queue   []task
+	pending map[task]bool
+	timers  []*frame
+
+	currentTime float64
+	calledExit  bool
+	err         error
+}
+
+// An ExitError is returned by Interpret when main fails, either by returning
+// a nonzero exit status or an Error, whose reason is kept.
+type ExitError struct {
+	Code   int
+	Reason string
+}
+
+func (e *ExitError) Error() string {
+	if e.Reason != "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Interpret compiles the given module, and runs it without going through C,
+// passing it args and the standard streams.
+func Interpret(main string, resolver Resolver, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	program, err := loadProgram(main, resolver)
+	if err != nil {
+		return err
+	}
+
+	m := &machine{
+		functions: map[string]*generator{},
+		stdout:    stdout,
+		stderr:    stderr,
+		stdin:     bufio.NewReader(stdin),
+		pending:   map[task]bool{},
+	}
+	for _, gen := range program.GeneratedFunctions {
+		m.functions[gen.Name] = gen
+	}
+
+	gen := m.functions["main"]
+	status, err := gen.ExitStatus()
+	if err != nil {
+		return err
+	}
+
+	st := m.newFrame(gen)
+	for i, kind := range gen.ArgKinds {
+		if kind.IsArgs() {
+			st.r[i] = future{value: makeArgs(args), ready: true}
+		} else {
+			st.r[i] = future{value: singleton(kind.Family.String()), ready: true}
+		}
+	}
+	for i := range gen.ReturnKind {
+		st.result[i] = &future{}
+	}
+	st.caller = &exitTask{}
+
+	m.schedule(st)
+	m.loop()
+	if m.err != nil || status < 0 {
+		return m.err
+	}
+	return exitError(gen.ReturnKind[status], st.result[status].value)
+}
+
+func makeArgs(args []string) []value {
+	result := []value{}
+	for _, arg := range args {
+		result = append(result, arg)
+	}
+	return result
+}
+
+// exitError is the ExitError for the exit status that main returned, which
+// is nil if the program succeeded.
+func exitError(kind *Kind, status value) error {
+	if union, ok := status.(unionValue); ok {
+		member := kind.UnpackAsUnion()[union.Tag]
+		if member.IsError() {
+			return &ExitError{Code: 1, Reason: string(union.Value.(errorValue))}
+		}
+		if member.Family != FamilyInteger {
+			return nil
+		}
+		status = union.Value
+	}
+	if code := status.(int64); code != 0 {
+		return &ExitError{Code: int(code)}
+	}
+	return nil
+}
+
+// Fail aborts the program with the given runtime error.
+func (m *machine) Fail(format string, args ...interface{}) {
+	if m.err == nil {
+		m.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (m *machine) newFrame(gen *generator) *frame {
+	return &frame{
+		function:   gen,
+		r:          make([]future, len(gen.Registers)),
+		result:     make([]*future, gen.Results),
+		conditions: make([]bool, gen.NextCondition+1),
+		calls:      make([]*frame, len(gen.ChildCalls)),
+		callsDone:  make([]bool, len(gen.ChildCalls)),
+	}
+}
+
+// newCallee allocates the state for a call to the named function, which may
+// be native.
+func (m *machine) newCallee(name string) *frame {
+	gen, ok := m.functions[name]
+	if !ok {
+		m.Fail("no function %s", name)
+		return nil
+	}
+	if !gen.IsNative {
+		return m.newFrame(gen)
+	}
+	native, ok := nativeAsyncFunctions[name]
+	if !ok {
+		m.Fail("native function %s is not supported by the interpreter", name)
+		return nil
+	}
+	return &frame{
+		native:     native,
+		r:          make([]future, len(gen.ArgKinds)),
+		result:     make([]*future, gen.Results),
+		conditions: make([]bool, 1),
+	}
+}
+
+func (m *machine) schedule(t task) {
+	// Ignore duplicated calls to schedule the same function, as the C runtime
+	// does.
+	if m.pending[t] {
+		return
+	}
+	m.pending[t] = true
+	m.queue = append(m.queue, t)
+}
+
+func (m *machine) finishCurrentIteration() {
+	for len(m.queue) > 0 && m.err == nil {
+		t := m.queue[0]
+		t.run(m)
+		m.queue = m.queue[1:]
+		delete(m.pending, t)
+	}
+}
+
+func (m *machine) loop() {
+	for m.err == nil {
+		m.finishCurrentIteration()
+		if len(m.timers) == 0 {
+			break
+		}
+
+		// Look for the next timer event.
+		next := (*frame)(nil)
+		for _, timer := range m.timers {
+			if timer != nil && (next == nil || timer.triggerTime < next.triggerTime) {
+				next = timer
+			}
+		}
+		if next == nil {
+			// There's nothing left to do, so free up all the completed slots.
+			m.timers = nil
+			continue
+		}
+
+		for i, timer := range m.timers {
+			if timer == nil || timer.triggerTime > next.triggerTime {
+				continue
+			}
+			m.schedule(timer.caller)
+			timer.result[0].value = timer.r[0].value
+			timer.result[0].ready = true
+			m.timers[i] = nil
+		}
+		m.currentTime = next.triggerTime
+	}
+
+	if m.err != nil {
+		return
+	}
+	fmt.Fprintf(m.stdout, "finished after %0.1fs\n", m.currentTime)
+	if !m.calledExit {
+		m.Fail("program finished without returning from main")
+	}
+}
+
+func (e *exitTask) run(m *machine) {
+	// All timers must have been fired or cancelled.
+	for _, timer := range m.timers {
+		if timer != nil {
+			m.Fail("main returned with a pending timer")
+		}
+	}
+	if len(m.queue) != 1 {
+		m.Fail("main returned with %d pending calls", len(m.queue)-1)
+	}
+	m.calledExit = true
+}
+
+// Reg returns the future that holds the given register.
+func (f *frame) Reg(r register) *future {
+	return &f.r[f.function.ResolveRegister(r)]
+}
+
+func (f *frame) run(m *machine) {
+	if f.freed {
+		return
+	}
+	if f.native != nil {
+		f.native(m, f)
+		return
+	}
+
+	g := f.function
+	if !f.conditions[0] {
+		for i := range f.conditions {
+			f.conditions[i] = false
+		}
+		f.conditions[0] = true
+		for i := range f.calls {
+			f.calls[i] = nil
+			f.callsDone[i] = false
+		}
+	}
+
+	for _, stmtWithCondition := range g.Conditions {
+		if !f.conditions[stmtWithCondition.Cond] {
+			continue
+		}
+		stmt := stmtWithCondition.Statement
+
+		if !f.canRun(stmt) {
+			continue
+		}
+
+		stmt.Interpret(m, f)
+		if f.freed || m.err != nil {
+			return
+		}
+	}
+
+	// Iterate in reverse order, propagate the cancellation status.
+	for i := len(g.Conditions) - 1; i >= 0; i -= 1 {
+		stmt := g.Conditions[i].Statement
+
+		needs, provides := stmt.Deps()
+		if len(provides) == 0 {
+			continue
+		}
+
+		cancelled := true
+		for _, provide := range provides {
+			if !f.Reg(provide).cancelled || f.Reg(provide).ready {
+				cancelled = false
+			}
+		}
+		if !cancelled {
+			continue
+		}
+
+		if cancel, ok := stmt.(interpretedStatementWithCancel); ok {
+			cancel.InterpretCancel(m, f)
+		} else {
+			for _, need := range needs {
+				f.Reg(need).cancelled = true
+			}
+		}
+	}
+}
+
+func (f *frame) canRun(stmt generatedStatement) bool {
+	needs, provides := stmt.Deps()
+	for _, need := range needs {
+		if !f.Reg(need).ready {
+			return false
+		}
+	}
+	for _, provide := range provides {
+		if f.Reg(provide).ready {
+			return false
+		}
+	}
+	return true
+}
+
+type interpretedStatementWithCancel interface {
+	InterpretCancel(*machine, *frame)
+}
+
+func (g *genRenameRegister) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Destination) = *f.Reg(g.Source)
+}
+
+func (g *genStringLiteral) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Target) = future{value: g.Value, ready: true}
+}
+
+func (g *genIntegerLiteral) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Target) = future{value: g.Value, ready: true}
+}
+
+func (g *genCallSyncFunction) Interpret(m *machine, f *frame) {
+	native, ok := nativeSyncFunctions[g.Name]
+	if !ok {
+		m.Fail("native function %s is not supported by the interpreter", g.Name)
+		return
+	}
+
+	args := []value{}
+	for _, arg := range g.Args {
+		args = append(args, f.Reg(arg).value)
+	}
+
+	results, err := native(m, args)
+	if err != nil {
+		m.Fail("%s: %w", g.Name, err)
+		return
+	}
+
+	for i, ret := range g.Result {
+		f.Reg(ret).value = results[i]
+		f.Reg(ret).ready = true
+	}
+}
+
+func (g *genCallAsyncFunction) Interpret(m *machine, f *frame) {
+	if f.calls[g.ChildCall] == nil {
+		child := m.newCallee(g.Name)
+		if child == nil {
+			return
+		}
+		for i, ret := range g.Result {
+			child.result[i] = f.Reg(ret)
+		}
+		child.caller = f
+		f.calls[g.ChildCall] = child
+	}
+
+	child := f.calls[g.ChildCall]
+	for i, arg := range g.Args {
+		child.r[i].value = f.Reg(arg).value
+		child.r[i].ready = f.Reg(arg).ready
+		f.Reg(arg).cancelled = child.r[i].cancelled
+	}
+	m.schedule(child)
+}
+
+func (g *genCallAsyncFunction) InterpretCancel(m *machine, f *frame) {
+	for _, arg := range g.Args {
+		f.Reg(arg).cancelled = true
+	}
+	if child := f.calls[g.ChildCall]; child != nil {
+		m.schedule(child)
+	}
+}
+
+func (g *genRestartLoop) Interpret(m *machine, f *frame) {
+	if f.callsDone[g.ChildCall] {
+		return
+	}
+
+	if f.calls[g.ChildCall] == nil {
+		child := m.newFrame(f.function)
+		copy(child.result, f.result)
+		child.caller = f.caller
+		f.calls[g.ChildCall] = child
+	}
+
+	child := f.calls[g.ChildCall]
+	ready := true
+	for i, arg := range g.Args {
+		child.r[i] = *f.Reg(arg)
+		ready = ready && f.Reg(arg).ready
+	}
+	m.schedule(child)
+
+	if ready {
+		f.callsDone[g.ChildCall] = true
+		f.freed = true
+	}
+}
+
+func (g *genComment) Interpret(m *machine, f *frame) {}
+
+func (g *genReturn) Interpret(m *machine, f *frame) {
+	for i, reg := range g.ReturnValue {
+		*f.result[i] = *f.Reg(reg)
+	}
+	m.schedule(f.caller)
+	f.freed = true
+}
+
+func (g *genBranch) Interpret(m *machine, f *frame) {
+	if f.Reg(g.Condition).value.(int64) != 0 {
+		f.conditions[g.IfTrue] = true
+	} else {
+		f.conditions[g.IfFalse] = true
+	}
+}
+
+func (g *genIntegerComparison) Interpret(m *machine, f *frame) {
+	left, right := f.Reg(g.Left).value.(int64), f.Reg(g.Right).value.(int64)
+	result := false
+	switch g.Operation {
+	case "<":
+		result = left < right
+	case "<=":
+		result = left <= right
+	case ">":
+		result = left > right
+	case ">=":
+		result = left >= right
+	case "==":
+		result = left == right
+	case "!=":
+		result = left != right
+	default:
+		m.Fail("unknown comparison %s", g.Operation)
+	}
+	*f.Reg(g.Result) = future{value: boolValue(result), ready: true}
+}
+
+func (g *genStringComparison) Interpret(m *machine, f *frame) {
+	left, right := f.Reg(g.Left).value.(string), f.Reg(g.Right).value.(string)
+	result := left == right
+	if g.Operation == "!=" {
+		result = !result
+	}
+	*f.Reg(g.Result) = future{value: boolValue(result), ready: true}
+}
+
+func (g *genNot) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Result) = future{value: boolValue(f.Reg(g.Input).value.(int64) == 0), ready: true}
+}
+
+func (g *genIntegerArithmetic) Interpret(m *machine, f *frame) {
+	left, right := f.Reg(g.Left).value.(int64), f.Reg(g.Right).value.(int64)
+	result := int64(0)
+	switch g.Operation {
+	case "+":
+		result = left + right
+	case "-":
+		result = left - right
+	case "*":
+		result = left * right
+	case "/":
+		if right != 0 {
+			result = left / right
+		}
+	case "%":
+		result = left
+		if right != 0 {
+			result = left % right
+		}
+	default:
+		m.Fail("unknown operator %s", g.Operation)
+	}
+	*f.Reg(g.Result) = future{value: result, ready: true}
+}
+
+func (g *genNewArray) Interpret(m *machine, f *frame) {
+	ary := []value{}
+	for _, val := range g.Values {
+		ary = append(ary, f.Reg(val).value)
+	}
+	*f.Reg(g.Result) = future{value: ary, ready: true}
+}
+
+func (g *genArrayElement) Interpret(m *machine, f *frame) {
+	elements := f.Reg(g.Array).value.([]value)
+	*f.Reg(g.Result) = future{value: elements[f.Reg(g.Index).value.(int64)], ready: true}
+}
+
+func (g *genArrayLength) Interpret(m *machine, f *frame) {
+	elements := f.Reg(g.Array).value.([]value)
+	*f.Reg(g.Result) = future{value: int64(len(elements)), ready: true}
+}
+
+func (g *genMakeTuple) Interpret(m *machine, f *frame) {
+	tuple := []value{}
+	for _, input := range g.Inputs {
+		tuple = append(tuple, f.Reg(input).value)
+	}
+	*f.Reg(g.Result) = future{value: tuple, ready: true}
+}
+
+func (g *genUnpackTuple) Interpret(m *machine, f *frame) {
+	tuple := f.Reg(g.Input).value.([]value)
+	for i, result := range g.Results {
+		*f.Reg(result) = future{value: tuple[i], ready: true}
+	}
+}
+
+func (g *genTupleField) Interpret(m *machine, f *frame) {
+	tuple := f.Reg(g.Input).value.([]value)
+	*f.Reg(g.Result) = future{value: tuple[g.Index], ready: true}
+}
+
+func (g *genCheckUnionType) Interpret(m *machine, f *frame) {
+	union := f.Reg(g.Input).value.(unionValue)
+	*f.Reg(g.Result) = future{value: boolValue(union.Tag == g.KindIndex), ready: true}
+}
+
+func (g *genMakeUnion) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Result) = future{value: unionValue{g.KindIndex, f.Reg(g.Input).value}, ready: true}
+}
+
+func (g *genExtractUnionValue) Interpret(m *machine, f *frame) {
+	union := f.Reg(g.Input).value.(unionValue)
+	*f.Reg(g.Result) = future{value: union.Value, ready: true}
+}
+
+func (g *genMakeFunction) Interpret(m *machine, f *frame) {
+	captured := []value{}
+	for _, reg := range g.Captured {
+		captured = append(captured, f.Reg(reg).value)
+	}
+	*f.Reg(g.Result) = future{value: &functionValue{g.Name, captured}, ready: true}
+}
+
+func (g *genCallFunctionValue) Interpret(m *machine, f *frame) {
+	if f.callsDone[g.ChildCall] {
+		return
+	}
+	f.callsDone[g.ChildCall] = true
+
+	fn := f.Reg(g.Function).value.(*functionValue)
+
+	// Synchronous native functions have no state, so they're called directly,
+	// as their start functions do in C.
+	if gen := m.functions[fn.Name]; gen != nil && gen.IsNative && gen.IsSynchronous {
+		(&genCallSyncFunction{fn.Name, g.Args, g.Result}).Interpret(m, f)
+		m.schedule(f)
+		return
+	}
+
+	child := m.newCallee(fn.Name)
+	if child == nil {
+		return
+	}
+	for i, arg := range g.Args {
+		child.r[i] = future{value: f.Reg(arg).value, ready: true}
+	}
+	for i, captured := range fn.Captured {
+		child.r[len(g.Args)+i] = future{value: captured, ready: true}
+	}
+	for i, ret := range g.Result {
+		child.result[i] = f.Reg(ret)
+	}
+	child.caller = f
+	m.schedule(child)
+}
+
+func (g *genKeepAlive) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Result) = *f.Reg(g.Value)
+}
+
+func (g *genDelete) Interpret(m *machine, f *frame) {
+	*f.Reg(g.Result) = future{ready: true}
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var nativeSyncFunctions = map[string]nativeSyncFunction{
+	"print": func(m *machine, args []value) ([]value, error) {
+		fmt.Fprintf(m.stdout, "%0.1fs %s\n", m.currentTime, args[1].(string))
+		return []value{args[0]}, nil
+	},
+	"println": func(m *machine, args []value) ([]value, error) {
+		fmt.Fprintln(m.stdout, args[1].(string))
+		return []value{args[0]}, nil
+	},
+	"eprintln": func(m *machine, args []value) ([]value, error) {
+		fmt.Fprintln(m.stderr, args[1].(string))
+		return []value{args[0]}, nil
+	},
+	"ReadLine": func(m *machine, args []value) ([]value, error) {
+		return []value{args[0], "World"}, nil
+	},
+	"len": func(m *machine, args []value) ([]value, error) {
+		return []value{int64(len(args[0].(string)))}, nil
+	},
+	"itoa": func(m *machine, args []value) ([]value, error) {
+		return []value{fmt.Sprintf("%d", args[0].(int64))}, nil
+	},
+	"primes": func(m *machine, args []value) ([]value, error) {
+		count := int64(0)
+		for n := args[0].(int64); n < args[1].(int64); n++ {
+			prime := n >= 2
+			for d := int64(2); d*d <= n && prime; d++ {
+				prime = n%d != 0
+			}
+			if prime {
+				count++
+			}
+		}
+		return []value{count}, nil
+	},
+	"concat": func(m *machine, args []value) ([]value, error) {
+		return []value{args[0].(string) + args[1].(string)}, nil
+	},
+	"copy": func(m *machine, args []value) ([]value, error) {
+		return []value{args[0]}, nil
+	},
+	"fork": func(m *machine, args []value) ([]value, error) {
+		return []value{args[0], args[0]}, nil
+	},
+	"join": func(m *machine, args []value) ([]value, error) {
+		return []value{args[0]}, nil
+	},
+	"append": func(m *machine, args []value) ([]value, error) {
+		return []value{append(args[0].([]value), args[1])}, nil
+	},
+	"length": func(m *machine, args []value) ([]value, error) {
+		return []value{int64(len(args[0].([]value)))}, nil
+	},
+	"get": func(m *machine, args []value) ([]value, error) {
+		elements, index := args[0].([]value), args[1].(int64)
+		if index < 0 || index >= int64(len(elements)) {
+			return nil, fmt.Errorf("index %d out of range for array of length %d", index, len(elements))
+		}
+		return []value{elements, elements[index]}, nil
+	},
+	"take": func(m *machine, args []value) ([]value, error) {
+		elements, index := args[0].([]value), args[1].(int64)
+		if index < 0 || index >= int64(len(elements)) {
+			return nil, fmt.Errorf("index %d out of range for array of length %d", index, len(elements))
+		}
+		rest := append(append([]value{}, elements[:index]...), elements[index+1:]...)
+		return []value{rest, elements[index]}, nil
+	},
+	"put": func(m *machine, args []value) ([]value, error) {
+		elements, index := args[0].([]value), args[1].(int64)
+		if index < 0 || index > int64(len(elements)) {
+			return nil, fmt.Errorf("index %d out of range for array of length %d", index, len(elements))
+		}
+		result := append(append(append([]value{}, elements[:index]...), args[2]), elements[index:]...)
+		return []value{result}, nil
+	},
+	"debug": func(m *machine, args []value) ([]value, error) {
+		elements := []string{}
+		for _, elem := range args[0].([]value) {
+			elements = append(elements, fmt.Sprintf("%d", elem.(int64)))
+		}
+		return []value{"[" + strings.Join(elements, ", ") + "]"}, nil
+	},
+	"mightfail": func(m *machine, args []value) ([]value, error) {
+		if args[0] == singleton("FileSystem") {
+			return []value{singleton("FileSystemWillFail"), unionValue{0, "Success!"}}, nil
+		}
+		return []value{singleton("FileSystem"), unionValue{1, errorValue("some error")}}, nil
+	},
+	"getenv": func(m *machine, args []value) ([]value, error) {
+		name := args[1].(string)
+		if setting, ok := os.LookupEnv(name); ok {
+			return []value{args[0], unionValue{0, setting}}, nil
+		}
+		return []value{args[0], unionValue{1, errorValue(fmt.Sprintf("getenv %s: not set", name))}}, nil
+	},
+	"reason": func(m *machine, args []value) ([]value, error) {
+		return []value{string(args[0].(errorValue))}, nil
+	},
+}
+
+// fileModes are the flags for each mode that a file can be opened in.
+var fileModes = map[string]int{
+	"r": os.O_RDONLY,
+	"w": os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"a": os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+}
+
+// fileResult is the Union[T, Error] returned by a file operation.
+func fileResult(result value, err error) unionValue {
+	if err != nil {
+		return unionValue{1, errorValue(err.Error())}
+	}
+	return unionValue{0, result}
+}
+
+// blocking makes an asynchronous native function out of one that runs to
+// completion as soon as its arguments are ready, as the file operations do in
+// the C runtime without libuv.
+func blocking(fn nativeSyncFunction) nativeAsyncFunction {
+	return func(m *machine, f *frame) {
+		args := []value{}
+		for _, arg := range f.r {
+			if !arg.ready {
+				return
+			}
+			args = append(args, arg.value)
+		}
+
+		// Make sure that repeated calls are ignored, emulating a user function.
+		if f.conditions[0] {
+			return
+		}
+		f.conditions[0] = true
+
+		results, err := fn(m, args)
+		if err != nil {
+			m.Fail("%s", err)
+			return
+		}
+		for i := range f.result {
+			f.result[i].value = results[i]
+			f.result[i].ready = true
+		}
+		m.schedule(f.caller)
+		f.freed = true
+	}
+}
+
+var nativeAsyncFunctions = map[string]nativeAsyncFunction{
+	"open": blocking(func(m *machine, args []value) ([]value, error) {
+		path, mode := args[1].(string), args[2].(string)
+		flags, ok := fileModes[mode]
+		if !ok {
+			err := fmt.Errorf("open %s: invalid mode %q", path, mode)
+			return []value{args[0], fileResult(nil, err)}, nil
+		}
+		file, err := os.OpenFile(path, flags, 0666)
+		return []value{args[0], fileResult(file, err)}, nil
+	}),
+	"read": blocking(func(m *machine, args []value) ([]value, error) {
+		data, err := ioutil.ReadAll(args[0].(*os.File))
+		return []value{args[0], fileResult(string(data), err)}, nil
+	}),
+	"write": blocking(func(m *machine, args []value) ([]value, error) {
+		n, err := args[0].(*os.File).WriteString(args[1].(string))
+		return []value{args[0], fileResult(int64(n), err)}, nil
+	}),
+	"close": blocking(func(m *machine, args []value) ([]value, error) {
+		err := args[1].(*os.File).Close()
+		return []value{args[0], fileResult(int64(1), err)}, nil
+	}),
+	"readln": blocking(func(m *machine, args []value) ([]value, error) {
+		line, err := m.stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return []value{args[0], unionValue{1, errorValue("readln: end of input")}}, nil
+		}
+		return []value{args[0], unionValue{0, strings.TrimSuffix(line, "\n")}}, nil
+	}),
+	"sleep": func(m *machine, f *frame) {
+		if f.result[0].cancelled && !f.r[0].cancelled {
+			f.r[0].cancelled = true
+
+			// Cancel the pending timer, if it has started.
+			if f.conditions[0] {
+				m.timers[f.timerSlot] = nil
+			}
+
+			f.result[0].value = f.r[0].value
+			f.result[0].ready = true
+			m.schedule(f.caller)
+			f.freed = true
+			return
+		}
+
+		// Wait until the previous timer completes before starting this one.
+		if !f.r[0].ready || !f.r[1].ready {
+			return
+		}
+
+		// Make sure that repeated calls are ignored, emulating a user function.
+		if f.conditions[0] {
+			return
+		}
+
+		f.conditions[0] = true
+		f.triggerTime = m.currentTime + float64(f.r[1].value.(int64))
+
+		// Register the new timer in the runtime, and wake up the caller in
+		// case it needs to cancel this clock.
+		f.timerSlot = len(m.timers)
+		m.timers = append(m.timers, f)
+		m.schedule(f.caller)
+	},
+	"first": func(m *machine, f *frame) {
+		if f.r[0].ready && !f.r[1].ready && !f.r[1].cancelled {
+			f.r[1].cancelled = true
+			m.schedule(f.caller)
+			return
+		} else if f.r[1].ready && !f.r[0].ready && !f.r[0].cancelled {
+			f.r[0].cancelled = true
+			m.schedule(f.caller)
+			return
+		}
+
+		if !f.r[0].ready || !f.r[1].ready {
+			return
+		}
+
+		for i := range f.result {
+			f.result[i].value = f.r[i].value
+			f.result[i].ready = true
+		}
+		m.schedule(f.caller)
+		f.freed = true
+	},
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Resolver finds the source code for a module, given its name (as it
+// appears in an import statement).
+type Resolver interface {
+	Resolve(module string) (filename string, contents string, err error)
+}
+
+// SearchPath resolves modules by looking for "<module>.ht" in each directory,
+// in order.
+type SearchPath []string
+
+func (s SearchPath) Resolve(module string) (string, string, error) {
+	for _, dir := range s {
+		filename := filepath.Join(dir, module+".ht")
+		contents, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", "", err
+		}
+		return filename, string(contents), nil
+	}
+	return "", "", fmt.Errorf("no such module %s (searched %s)", module, strings.Join(s, ", "))
+}
+
+// ModuleForPath splits a command line argument into a module name and the
+// directory that holds it. Arguments that aren't paths to ".ht" files are
+// treated as bare module names, and have no directory.
+func ModuleForPath(arg string) (module string, dir string) {
+	if filepath.Ext(arg) != ".ht" {
+		return arg, ""
+	}
+	return strings.TrimSuffix(filepath.Base(arg), ".ht"), filepath.Dir(arg)
+}
@@ -15,6 +15,7 @@
 package unique_effect
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -24,9 +25,20 @@ import (
 )
 
 type TypeRep struct {
-	Borrowed bool       `@"&"?`
-	Name     string     `@Ident`
-	Args     []*TypeRep `("[" @@ ("," @@)* "]")?`
+	Borrowed bool         `@"&"?`
+	Func     *FuncTypeRep `( @@`
+	Name     string       `| @Ident`
+	Args     []*TypeRep   `  ("[" @@ ("," @@)* "]")? )`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// A FuncTypeRep is the type of a function value, such as
+// func(Integer, &String): Boolean.
+type FuncTypeRep struct {
+	Params  []*TypeRep `"func" "(" (@@ ("," @@)*)? ")"`
+	Results []*TypeRep `":" (@@ | "(" @@ ("," @@)* ")")`
 }
 
 type Family int
@@ -36,6 +48,14 @@ type Kind struct {
 	Family           Family
 	TupleOrUnionArgs []*Kind
 	Label            string
+
+	// TypeArgs are the type arguments of a generic struct, such as Integer
+	// in Box[Integer]. The fields themselves are in TupleOrUnionArgs.
+	TypeArgs []*Kind
+
+	// Results are what a function value returns; its parameters are in
+	// TupleOrUnionArgs.
+	Results []*Kind
 }
 
 const (
@@ -47,7 +67,13 @@ const (
 	FamilyBoolean
 	FamilyArray
 	FamilyFileSystem
+	FamilyFile
+	FamilyEnvironment
+	FamilyStdout
+	FamilyStderr
+	FamilyStdin
 	FamilyUnion
+	FamilyFunction
 	FamilyCustom
 )
 
@@ -69,8 +95,20 @@ func (f Family) String() string {
 		return "Array"
 	case FamilyFileSystem:
 		return "FileSystem"
+	case FamilyFile:
+		return "File"
+	case FamilyEnvironment:
+		return "Environment"
+	case FamilyStdout:
+		return "Stdout"
+	case FamilyStderr:
+		return "Stderr"
+	case FamilyStdin:
+		return "Stdin"
 	case FamilyUnion:
 		return "Union"
+	case FamilyFunction:
+		return "Function"
 	case FamilyCustom:
 		return "Custom"
 	default:
@@ -94,6 +132,16 @@ func CaptureFamily(name string) (Family, error) {
 		return FamilyArray, nil
 	case "FileSystem":
 		return FamilyFileSystem, nil
+	case "File":
+		return FamilyFile, nil
+	case "Environment":
+		return FamilyEnvironment, nil
+	case "Stdout":
+		return FamilyStdout, nil
+	case "Stderr":
+		return FamilyStderr, nil
+	case "Stdin":
+		return FamilyStdin, nil
 	case "Union":
 		return FamilyUnion, nil
 	default:
@@ -106,10 +154,17 @@ func (k Kind) String() string {
 	if k.Borrowed {
 		result += "&"
 	}
+	if k.Family == FamilyFunction {
+		return result + formatFuncType(k.TupleOrUnionArgs, k.Results)
+	}
 	result += k.Label
-	if len(k.TupleOrUnionArgs) > 0 {
+	args := k.TupleOrUnionArgs
+	if len(k.TypeArgs) > 0 {
+		args = k.TypeArgs
+	}
+	if len(args) > 0 {
 		result += "["
-		for i, arg := range k.TupleOrUnionArgs {
+		for i, arg := range args {
 			if i > 0 {
 				result += ", "
 			}
@@ -120,8 +175,38 @@ func (k Kind) String() string {
 	return result
 }
 
+// formatFuncType prints the type of a function value.
+func formatFuncType(params, results []*Kind) string {
+	names := []string{}
+	for _, param := range params {
+		names = append(names, param.String())
+	}
+	result := "func(" + strings.Join(names, ", ") + "): "
+
+	names = []string{}
+	for _, ret := range results {
+		names = append(names, ret.String())
+	}
+	if len(names) == 1 {
+		return result + names[0]
+	}
+	return result + "(" + strings.Join(names, ", ") + ")"
+}
+
+// sameShape is whether two kinds are the same type, ignoring whether they're
+// borrowed at the top level.
+func (k Kind) sameShape(other Kind) bool {
+	if k.Family != other.Family || k.Label != other.Label || !sameKinds(k.TypeArgs, other.TypeArgs) {
+		return false
+	}
+	if k.Family == FamilyFunction {
+		return sameKinds(k.TupleOrUnionArgs, other.TupleOrUnionArgs) && sameKinds(k.Results, other.Results)
+	}
+	return true
+}
+
 func (k Kind) CanConvertTo(other Kind) error {
-	if k.Family != other.Family || k.Label != other.Label {
+	if !k.sameShape(other) {
 		return fmt.Errorf("Type error, expecting %v, got %s", other, k.String())
 	}
 	if !other.Borrowed && k.Borrowed {
@@ -131,7 +216,7 @@ func (k Kind) CanConvertTo(other Kind) error {
 }
 
 func (k Kind) IsEquivalent(other Kind) error {
-	if k.Family != other.Family || k.Label != other.Label || k.Borrowed != other.Borrowed {
+	if !k.sameShape(other) || k.Borrowed != other.Borrowed {
 		return fmt.Errorf("%v vs. %v", other, k)
 	}
 	return nil
@@ -141,8 +226,17 @@ func (k Kind) NeedsToBeDeleted() bool {
 	return !k.IsPrimitive() && !k.Borrowed
 }
 
+// CanBeImplicitlyDeleted is whether a value can be dropped without being
+// used. Arrays can be, as long as their elements can be too.
 func (k Kind) CanBeImplicitlyDeleted() bool {
-	return k.Family == FamilyString || k.Family == FamilyArray
+	switch k.Family {
+	case FamilyString, FamilyFunction:
+		return true
+	case FamilyArray:
+		elem := k.TupleOrUnionArgs
+		return len(elem) == 0 || elem[0] == nil || elem[0].IsPrimitive() || elem[0].CanBeImplicitlyDeleted()
+	}
+	return false
 }
 
 func (k Kind) IsPrimitive() bool {
@@ -157,12 +251,51 @@ func (k Kind) IsBooleanLike() bool {
 	return k.Family == FamilyBoolean
 }
 
+// IsEffect is true for the kinds that stand for the outside world, which are
+// passed from function to function rather than created.
+func (k Kind) IsEffect() bool {
+	switch k.Family {
+	case FamilyClock, FamilyStream, FamilyFileSystem, FamilyEnvironment, FamilyStdout, FamilyStderr, FamilyStdin:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsArgs is true for Array[String], which main takes to get its command-line
+// arguments.
+func (k Kind) IsArgs() bool {
+	elem := k.TupleOrUnionArgs
+	return k.Family == FamilyArray && !k.Borrowed && len(elem) == 1 && elem[0] != nil && elem[0].Family == FamilyString
+}
+
+// IsExitStatus is true for the kinds that main can return to set the exit
+// status of the program: an Integer, or a Union that might hold an Error.
+func (k Kind) IsExitStatus() bool {
+	if k.Family == FamilyInteger {
+		return true
+	}
+	if k.Family != FamilyUnion {
+		return false
+	}
+	for _, member := range k.UnpackAsUnion() {
+		if member.IsError() {
+			return true
+		}
+	}
+	return false
+}
+
+func (k Kind) IsError() bool {
+	return k.Family == FamilyCustom && k.Label == "Error"
+}
+
 func (k Kind) CanBeArgumentToMain() bool {
-	return k.Family == FamilyClock || k.Family == FamilyStream || k.Family == FamilyFileSystem
+	return k.IsEffect() || k.IsArgs()
 }
 
 func (k Kind) CanBeReturnedFromMain() bool {
-	return k.Family == FamilyClock || k.Family == FamilyStream || k.Family == FamilyFileSystem
+	return k.IsEffect() || k.IsExitStatus()
 }
 
 func (k Kind) UnpackAsTuple() []*Kind {
@@ -174,12 +307,15 @@ func (k Kind) UnpackAsUnion() []*Kind {
 }
 
 type astHangTen struct {
-	Imports     []*astImport           `EOL* @@*`
-	Definitions []*astFunctionOrStruct `     @@*`
+	Imports     []*astImport           `EOL* (@@ EOL+)*`
+	Definitions []*astFunctionOrStruct `     (@@ EOL+)*`
 }
 
 type astImport struct {
-	ModuleName string `"import" @Ident EOL+`
+	ModuleName string `"import" @Ident`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astFunctionOrStruct struct {
@@ -188,53 +324,108 @@ type astFunctionOrStruct struct {
 }
 
 type astStruct struct {
-	Name   string     `"struct" @Ident`
-	Fields []*TypeRep `"{" (EOL+ (@@ EOL+)+)? "}" EOL+`
+	Name       string      `"struct" @Ident`
+	TypeParams []string    `("[" @Ident ("," @Ident)* "]")?`
+	Fields     []*astField `"{" (EOL+ (@@ EOL+)+)? "}"`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// Fields are either all named (as in "name: String"), or all positional.
+type astField struct {
+	Name string   `(@Ident ":")?`
+	Kind *TypeRep `@@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// FieldIndex returns the position of the named field in the struct.
+func (a *astStruct) FieldIndex(name string) (int, bool) {
+	for i, field := range a.Fields {
+		if field.Name != "" && field.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (a *astStruct) HasNamedFields() bool {
+	return len(a.Fields) > 0 && a.Fields[0].Name != ""
 }
 
 type astFunction struct {
 	IsSynchronous bool       `@"sync"?`
 	IsNative      bool       `@"native"?`
 	Name          string     `'func' @Ident`
+	TypeParams    []string   `("[" @Ident ("," @Ident)* "]")?`
 	Args          []*astArg  `'(' @@* (',' @@*)* ')'`
 	ReturnKind    []*TypeRep `":" (@@ | "(" @@ ("," @@)* ")")`
-	Block         *astBlock  `@@? EOL+`
+	Block         *astBlock  `@@?`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// An argumentError is a problem with one of the arguments passed to a
+// function, so that it can be reported at that argument.
+type argumentError struct {
+	Index int
+	Err   error
 }
 
-func (a *astFunction) ReturnValue(p *program, args []*Kind) ([]*Kind, error) {
+func (e *argumentError) Error() string {
+	return e.Err.Error()
+}
+
+// ReturnValue checks a call to the function with arguments of the given
+// kinds, returning the name of the code to call and the kinds of the results.
+// The type arguments of generic functions are inferred from the arguments.
+func (a *astFunction) ReturnValue(p *program, args []*Kind) (string, []*Kind, error) {
 	if len(args) != len(a.Args) {
-		return nil, fmt.Errorf("Type error: argument count mismatch, expecting %d, got %d", len(a.Args), len(args))
+		return "", nil, newError(CodeArity, "Type error: argument count mismatch, expecting %d, got %d", len(a.Args), len(args)).
+			WithRelated(newSpan(a.Pos, a.EndPos), "%s is defined here", a.Name)
+	}
+
+	typeArgs, err := a.inferTypeArgs(args)
+	if err != nil {
+		return "", nil, err
 	}
 
 	for i, arg := range a.Args {
-		resolved, err := p.ResolveType(arg.Kind)
+		resolved, err := p.resolveType(arg.Kind, typeArgs)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 		if err := args[i].CanConvertTo(*resolved); err != nil {
-			return nil, err
+			return "", nil, &argumentError{i, err}
 		}
 	}
 
 	result := []*Kind{}
 	for _, rep := range a.ReturnKind {
-		resolved, err := p.ResolveType(rep)
+		resolved, err := p.resolveType(rep, typeArgs)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 		result = append(result, resolved)
 	}
 
-	return result, nil
+	name, err := p.instantiate(a, typeArgs)
+	return name, result, err
 }
 
 type astArg struct {
 	Name string   `@Ident`
 	Kind *TypeRep `':' @@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astBlock struct {
-	Statements []*astStmt `'{' EOL* @@* '}'`
+	Statements []*astStmt `'{' EOL* (@@ EOL+)* '}'`
 }
 
 type astStmt struct {
@@ -242,7 +433,10 @@ type astStmt struct {
 	Return   *astReturnStmt      `| @@`
 	Cond     *astConditionalStmt `| @@`
 	Repeat   *astRepeatStmt      `| @@`
-	BareExpr *astExpression      `| @@ ) EOL+`
+	For      *astForStmt         `| @@`
+	Jump     *astJumpStmt        `| @@`
+	Match    *astMatchStmt       `| @@`
+	BareExpr *astExpression      `| @@ )`
 
 	Pos    lexer.Position
 	EndPos lexer.Position
@@ -252,22 +446,74 @@ type astLetStmt struct {
 	MustExist bool           `("let" | @"set")`
 	VarNames  []string       `@Ident ("," @Ident)*`
 	Value     *astExpression `"=" @@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astReturnStmt struct {
 	Value *astExpression `"return" @@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astRepeatStmt struct {
 	Condition *astExpression `"while" @@`
 	Block     *astBlock      `@@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// An astForStmt runs its block once for each element of an array, in order.
+// Iterating over an owned array consumes it, moving each element into the
+// block; iterating over &array lends each element to the block instead.
+type astForStmt struct {
+	Elem   string         `"for" @Ident "in"`
+	Borrow bool           `@"&"?`
+	Array  *astExpression `@@`
+	Block  *astBlock      `@@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// An astJumpStmt leaves the innermost loop (break), or skips the rest of the
+// current iteration of it (continue).
+type astJumpStmt struct {
+	Keyword string `@("break" | "continue")`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astConditionalStmt struct {
-	Cond           *astExpression `"if" @@`
-	TypeAssertKind *TypeRep       `("is" @@)?`
-	IfTrue         *astBlock      `@@`
-	Otherwise      *astBlock      `"else" @@`
+	Cond           *astExpression      `"if" @@`
+	TypeAssertKind *TypeRep            `("is" @@)?`
+	IfTrue         *astBlock           `@@`
+	ElseIf         *astConditionalStmt `("else" ( @@`
+	Otherwise      *astBlock           `        | @@ ))?`
+}
+
+type astMatchStmt struct {
+	Subject *astIdent      `"match" @@ "{" EOL*`
+	Arms    []*astMatchArm `(@@ EOL+)* "}"`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+type astMatchArm struct {
+	Kind  *TypeRep  `@@ "=>"`
+	Block *astBlock `@@`
+}
+
+type astIdent struct {
+	Name string `@Ident`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astMethodCall struct {
@@ -275,59 +521,166 @@ type astMethodCall struct {
 }
 
 type astMethodArg struct {
-	Borrow *string        `  "&" @Ident`
+	Borrow *string        `  "&" @Ident (@"." @Ident)*`
 	Expr   *astExpression `| @@`
 
-	Pos lexer.Position
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
+// Operators bind from loosest to tightest: "||", "&&", comparisons, "+" and
+// "-", "*", "/" and "%", then "!".
 type astExpression struct {
+	Operands []*astConjunction `@@ ("||" @@)*`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+type astConjunction struct {
+	Operands []*astComparisonExpression `@@ ("&&" @@)*`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+type astComparisonExpression struct {
 	Sum        *astExpressionSum `@@`
 	Comparison *astComparison    `@@?`
 
-	Pos lexer.Position
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astComparison struct {
-	Cond    string            `@(">=" | "<=" | "<" | ">")`
+	Cond    string            `@("==" | "!=" | ">=" | "<=" | "<" | ">")`
 	Operand *astExpressionSum `@@`
 }
 
 type astExpressionSum struct {
-	Call  *astExpressionCall `@@`
-	Terms []*astTerm         `@@*`
+	Product *astExpressionProduct `@@`
+	Terms   []*astTerm            `@@*`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astTerm struct {
-	Op      string             `@"+"`
-	Operand *astExpressionCall `@@`
+	Op      string                `@("+" | "-")`
+	Operand *astExpressionProduct `@@`
+
+	EndPos lexer.Position
+}
+
+type astExpressionProduct struct {
+	Operand *astExpressionUnary `@@`
+	Factors []*astFactor        `@@*`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+type astFactor struct {
+	Op      string              `@("*" | "/" | "%")`
+	Operand *astExpressionUnary `@@`
+
+	EndPos lexer.Position
+}
+
+type astExpressionUnary struct {
+	Not  *astExpressionUnary `  "!" @@`
+	Call *astExpressionCall  `| @@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astExpressionCall struct {
-	Base  *astExpressionBase `@@`
-	Calls []*astMethodCall   `@@*`
+	Base   *astExpressionBase `@@`
+	Calls  []*astMethodCall   `@@*`
+	Fields []string           `("." @Ident)*`
+	With   []*astStructArg    `("with" "{" @@ ("," @@)* "}")?`
+	Try    bool               `@"?"?`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astExpressionBase struct {
-	Variable        *string          `  @Ident`
-	StructArguments []*astExpression `  ("{" @@ ("," @@)+ "}")?`
+	Lambda          *astLambda       `  @@`
+	Variable        *string          `| @Ident`
+	StructArguments []*astStructArg  `  ("{" @@ ("," @@)* "}")?`
 	String          *string          `| @String`
-	Tuple           []*astExpression `| "(" @@ ("," @@)+ ")"`
+	Tuple           []*astExpression `| "(" @@ ("," @@)* ")"`
 	Integer         *int64           `| @Int`
 	IsArray         bool             `| @("["`
 	Array           []*astExpression `  (@@ ("," @@)*)? "]")`
 
-	Pos lexer.Position
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+// An astLambda is a function written as an expression. Its body can use the
+// local variables around it.
+type astLambda struct {
+	Args       []*astArg  `"func" "(" (@@ ("," @@)*)? ")"`
+	ReturnKind []*TypeRep `":" (@@ | "(" @@ ("," @@)* ")")`
+	Block      *astBlock  `@@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
+}
+
+func (t *TypeRep) Span() Span                 { return newSpan(t.Pos, t.EndPos) }
+func (a *astLambda) Span() Span               { return newSpan(a.Pos, a.EndPos) }
+func (a *astArg) Span() Span                  { return newSpan(a.Pos, a.EndPos) }
+func (a *astStruct) Span() Span               { return newSpan(a.Pos, a.EndPos) }
+func (a *astStmt) Span() Span                 { return newSpan(a.Pos, a.EndPos) }
+func (a *astLetStmt) Span() Span              { return newSpan(a.Pos, a.EndPos) }
+func (a *astReturnStmt) Span() Span           { return newSpan(a.Pos, a.EndPos) }
+func (a *astMatchStmt) Span() Span            { return newSpan(a.Pos, a.EndPos) }
+func (a *astIdent) Span() Span                { return newSpan(a.Pos, a.EndPos) }
+func (a *astRepeatStmt) Span() Span           { return newSpan(a.Pos, a.EndPos) }
+func (a *astForStmt) Span() Span              { return newSpan(a.Pos, a.EndPos) }
+func (a *astJumpStmt) Span() Span             { return newSpan(a.Pos, a.EndPos) }
+func (a *astMethodArg) Span() Span            { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpression) Span() Span           { return newSpan(a.Pos, a.EndPos) }
+func (a *astConjunction) Span() Span          { return newSpan(a.Pos, a.EndPos) }
+func (a *astComparisonExpression) Span() Span { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpressionUnary) Span() Span      { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpressionSum) Span() Span        { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpressionProduct) Span() Span    { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpressionCall) Span() Span       { return newSpan(a.Pos, a.EndPos) }
+func (a *astExpressionBase) Span() Span       { return newSpan(a.Pos, a.EndPos) }
+
+type astStructArg struct {
+	Name  *string        `(@Ident ":")?`
+	Value *astExpression `@@`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
+func (a *astStructArg) Span() Span { return newSpan(a.Pos, a.EndPos) }
+func (a *astField) Span() Span     { return newSpan(a.Pos, a.EndPos) }
+
 type program struct {
 	Functions          map[string]*astFunction
 	GeneratedFunctions []*generator
-	Types              map[string][]*TypeRep
+	Types              map[string]*astStruct
+	Diagnostics        Diagnostics
+
+	// Instances maps each instantiation of a generic function, such as
+	// "map[Integer, String]", to the name of its generated code.
+	Instances map[string]string
+
+	// FunctionValues are the functions that are used as values, rather than
+	// only being called by name.
+	FunctionValues map[string]bool
 }
 
 func (p *program) MustResolveBuiltinType(label string) *Kind {
-	kind, err := p.ResolveType(&TypeRep{label == "String", label, nil})
+	kind, err := p.ResolveType(&TypeRep{Borrowed: label == "String", Name: label})
 	if err != nil {
 		panic(err)
 	}
@@ -335,12 +688,45 @@ func (p *program) MustResolveBuiltinType(label string) *Kind {
 }
 
 func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
+	return p.resolveType(t, nil)
+}
+
+// resolveType looks up a type, where typeArgs holds the types to substitute
+// for any type parameters in scope.
+func (p *program) resolveType(t *TypeRep, typeArgs map[string]*Kind) (*Kind, error) {
 	var (
-		family Family
-		args   []*Kind
+		family   Family
+		args     []*Kind
+		generics []*Kind
 	)
 
-	if t.Name == "Union" || t.Name == "Tuple" || t.Name == "Array" {
+	if t.Func != nil {
+		kind := &Kind{Borrowed: t.Borrowed, Family: FamilyFunction, Label: "func"}
+		for _, param := range t.Func.Params {
+			resolved, err := p.resolveType(param, typeArgs)
+			if err != nil {
+				return nil, err
+			}
+			kind.TupleOrUnionArgs = append(kind.TupleOrUnionArgs, resolved)
+		}
+		for _, ret := range t.Func.Results {
+			resolved, err := p.resolveType(ret, typeArgs)
+			if err != nil {
+				return nil, err
+			}
+			kind.Results = append(kind.Results, resolved)
+		}
+		return kind, nil
+
+	} else if bound, ok := typeArgs[t.Name]; ok {
+		if len(t.Args) > 0 {
+			return nil, newError(CodeUnknownType, "type parameter %s doesn't take arguments", t.Name).At(newSpan(t.Pos, t.EndPos))
+		}
+		kind := *bound
+		kind.Borrowed = t.Borrowed
+		return &kind, nil
+
+	} else if t.Name == "Union" || t.Name == "Tuple" || t.Name == "Array" {
 		// Generic type (has type arguments)
 		if t.Name == "Union" {
 			family = FamilyUnion
@@ -351,7 +737,7 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 		}
 
 		for _, arg := range t.Args {
-			resolved, err := p.ResolveType(arg)
+			resolved, err := p.resolveType(arg, typeArgs)
 			if err != nil {
 				return nil, err
 			}
@@ -359,26 +745,38 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 		}
 
 	} else {
-		// Regular type (with no args)
-		if len(t.Args) > 0 {
-			return nil, fmt.Errorf("type %s doesn't take arguments", t.Name)
+		strct, ok := p.Types[t.Name]
+		if (!ok || len(strct.TypeParams) == 0) && len(t.Args) > 0 {
+			return nil, newError(CodeUnknownType, "type %s doesn't take arguments", t.Name).At(newSpan(t.Pos, t.EndPos))
+		} else if !ok {
+			return nil, newError(CodeUnknownType, "unknown type %s", t.Name).At(newSpan(t.Pos, t.EndPos))
+		} else if len(t.Args) != len(strct.TypeParams) {
+			return nil, newError(CodeUnknownType, "wrong number of type arguments for %s: expected %d, got %d", t.Name, len(strct.TypeParams), len(t.Args)).
+				At(newSpan(t.Pos, t.EndPos)).
+				WithRelated(strct.Span(), "%s is defined here", t.Name)
 		}
 
-		fields, ok := p.Types[t.Name]
-		if !ok {
-			return nil, fmt.Errorf("unknown type %s", t.Name)
+		// Fields are resolved with the struct's own type parameters in scope.
+		fieldArgs := map[string]*Kind{}
+		for i, arg := range t.Args {
+			resolved, err := p.resolveType(arg, typeArgs)
+			if err != nil {
+				return nil, err
+			}
+			generics = append(generics, resolved)
+			fieldArgs[strct.TypeParams[i]] = resolved
 		}
 
 		// If the type has fields, fill them in as though they were type arguments
-		for _, field := range fields {
-			resolved, err := p.ResolveType(field)
+		for _, field := range strct.Fields {
+			resolved, err := p.resolveType(field.Kind, fieldArgs)
 			if err != nil {
 				return nil, err
 			}
 			args = append(args, resolved)
 		}
 
-		if len(fields) > 0 {
+		if len(strct.Fields) > 0 {
 			family = FamilyTuple
 		} else {
 			fam, err := CaptureFamily(t.Name)
@@ -394,6 +792,7 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 		Family:           family,
 		TupleOrUnionArgs: args,
 		Label:            t.Name,
+		TypeArgs:         generics,
 	}, nil
 }
 
@@ -402,6 +801,7 @@ var ufLexer = stateful.MustSimple([]stateful.Rule{
 	{`String`, `"(?:\\.|[^"])*"`, nil},
 	{`Int`, `\d+`, nil},
 	{`EOL`, `[\r\n]`, nil},
+	{"Operator", `==|!=|<=|>=|&&|\|\||=>`, nil},
 	{"comment", `//[^\n]*`, nil},
 	{"Punct", `[-[!@#$%^&*()+_={}\|:;"'<,>.?/]|]`, nil},
 	{"whitespace", `[ \t]`, nil},
@@ -410,64 +810,122 @@ var ufLexer = stateful.MustSimple([]stateful.Rule{
 var parser = participle.MustBuild(
 	&astHangTen{},
 	participle.Lexer(ufLexer),
-	participle.Unquote("String"))
+	participle.Unquote("String"),
+	participle.UseLookahead(2))
 
-func Parse(main string, sources map[string]string) (map[string]string, error) {
-	program := &program{map[string]*astFunction{}, []*generator{}, map[string][]*TypeRep{}}
+func loadProgram(main string, resolver Resolver) (*program, error) {
+	program := &program{map[string]*astFunction{}, []*generator{}, map[string]*astStruct{}, Diagnostics{}, map[string]string{}, map[string]bool{}}
 
-	queue := []string{main}
-	nextQueue := []string{}
+	// Modules are resolved as they are imported. The main module has no
+	// import statement, so failing to find it isn't a diagnostic.
+	queue := []*astImport{{ModuleName: main}}
+	loaded := map[string]bool{main: true}
+	sources := map[string]string{}
 
 	for len(queue) > 0 {
-		for _, mod := range queue {
-			filename := mod + ".ht"
-			input, ok := sources[filename]
-			if !ok {
-				return nil, fmt.Errorf("no such file: %s", filename)
-			}
+		imp := queue[0]
+		queue = queue[1:]
 
-			t := &astHangTen{}
-			if err := parser.ParseString(filename, input, t); err != nil {
+		filename, input, err := resolver.Resolve(imp.ModuleName)
+		if err != nil {
+			if imp.ModuleName == main {
 				return nil, err
 			}
+			program.Diagnostics.Add(newSpan(imp.Pos, imp.EndPos), asDiagnostic(CodeUnknownModule, err))
+			continue
+		}
+
+		sources[filename] = input
+
+		t := &astHangTen{}
+		if err := parser.ParseString(filename, input, t); err != nil {
+			pos := lexer.Position{Filename: filename, Line: 1, Column: 1}
+			if perr, ok := err.(participle.Error); ok {
+				pos, err = perr.Position(), errors.New(perr.Message())
+			}
+			program.Diagnostics.Add(newSpan(pos, pos), asDiagnostic(CodeSyntax, err))
+			continue
+		}
 
-			for _, imp := range t.Imports {
-				nextQueue = append(nextQueue, imp.ModuleName)
+		for _, imp := range t.Imports {
+			if !loaded[imp.ModuleName] {
+				loaded[imp.ModuleName] = true
+				queue = append(queue, imp)
 			}
+		}
 
-			for _, defn := range t.Definitions {
-				if fun := defn.Function; fun != nil {
-					if _, ok := program.Functions[fun.Name]; ok {
-						return nil, fmt.Errorf("function already exists: %s", fun.Name)
-					}
-					program.Functions[fun.Name] = fun
-				} else {
-					strct := defn.Struct
-					if _, ok := program.Types[strct.Name]; ok {
-						return nil, fmt.Errorf("type already exists: %s", strct.Name)
-					}
-					program.Types[strct.Name] = strct.Fields
+		for _, defn := range t.Definitions {
+			if fun := defn.Function; fun != nil {
+				if existing, ok := program.Functions[fun.Name]; ok {
+					program.Diagnostics.Add(newSpan(fun.Pos, fun.EndPos),
+						newError(CodeDuplicateDefinition, "function already exists: %s", fun.Name).
+							WithRelated(newSpan(existing.Pos, existing.EndPos), "first defined here"))
+					continue
+				}
+				program.Functions[fun.Name] = fun
+			} else {
+				strct := defn.Struct
+				if _, ok := program.Types[strct.Name]; ok {
+					program.Diagnostics.Add(newSpan(strct.Pos, strct.EndPos),
+						newError(CodeDuplicateDefinition, "type already exists: %s", strct.Name))
+					continue
 				}
+				program.Types[strct.Name] = strct
 			}
 		}
-		queue, nextQueue = nextQueue, queue[:0]
+	}
+
+	if len(program.Diagnostics) > 0 {
+		program.Diagnostics.trimSpans(sources)
+		program.Diagnostics.Sort()
+		return nil, program.Diagnostics
 	}
 
 	if _, ok := program.Functions["main"]; !ok {
-		return nil, fmt.Errorf("no main function defined in %s", main)
+		return nil, Diagnostics{newError(CodeNoMain, "no main function defined in %s", main)}
+	}
+
+	if len(program.Functions["main"].TypeParams) > 0 {
+		main := program.Functions["main"]
+		return nil, Diagnostics{newError(CodeNoMain, "main cannot take type parameters").At(newSpan(main.Pos, main.EndPos))}
 	}
 
+	// Generic functions are generated as they are called.
 	for _, fun := range program.Functions {
-		if err := fun.Generate(program); err != nil {
-			return nil, err
+		if len(fun.TypeParams) == 0 {
+			fun.Generate(program)
 		}
 	}
 
+	for _, gen := range program.GeneratedFunctions {
+		if program.FunctionValues[gen.Name] {
+			gen.IsFunctionValue = true
+		}
+	}
+
+	if len(program.Diagnostics) > 0 {
+		program.Diagnostics.trimSpans(sources)
+		program.Diagnostics.Sort()
+		return nil, program.Diagnostics
+	}
+
+	return program, nil
+}
+
+// Parse compiles the given module (and anything it imports) into C, returning
+// a map from output filenames to their contents. Imports are located using the
+// given resolver.
+func Parse(main string, resolver Resolver) (map[string]string, error) {
+	program, err := loadProgram(main, resolver)
+	if err != nil {
+		return nil, err
+	}
+
 	outputFiles := map[string]string{}
 
 	result := strings.Builder{}
 	fmt.Fprintf(&result, "#include <stdbool.h>\n")
-	fmt.Fprintf(&result, "#include \"../builtins.h\"\n")
+	fmt.Fprintf(&result, "#include \"builtins.h\"\n")
 	for _, defin := range program.GeneratedFunctions {
 		defin.TypeDefinition(&result)
 	}
@@ -482,6 +940,9 @@ func Parse(main string, sources map[string]string) (map[string]string, error) {
 	fmt.Fprintf(&result, "#include <stdint.h>\n")
 	for _, defin := range program.GeneratedFunctions {
 		defin.FormatInto(&result)
+		if defin.IsFunctionValue {
+			defin.FormatStartInto(&result)
+		}
 		if defin.Name == "main" {
 			if err := defin.FormatMainInto(&result); err != nil {
 				return nil, err
@@ -23,12 +23,25 @@ import (
 type generatedStatement interface {
 	Generate(block *generator) string
 	Deps() ([]register, []register)
+	Interpret(m *machine, f *frame)
 }
 
 type statementWithCancel interface {
 	GenerateCancel(*generator, io.Writer)
 }
 
+// statementWithInputs is implemented by statements that wait for their
+// inputs themselves, instead of listing them as needs in Deps.
+type statementWithInputs interface {
+	Inputs() []register
+}
+
+// statementWithBranches is implemented by statements that decide which
+// conditions hold, describing each one.
+type statementWithBranches interface {
+	Branches() map[condition]string
+}
+
 func freeGarbage(gen *generator, garbage map[register]*Kind, w io.Writer) {
 	for reg, kind := range garbage {
 		fmt.Fprintf(w, "        if (%s.ready) { // %s\n", gen.Reg(reg), kind)
@@ -36,7 +49,11 @@ func freeGarbage(gen *generator, garbage map[register]*Kind, w io.Writer) {
 		// 	fmt.Fprintf(w, "        struct unique_effect_array *ary = (struct unique_effect_array*)%s.value;\n", gen.Reg(reg))
 		// 	fmt.Fprintf(w, "        for (int i = 0; i < ary->length; i++) { free(ary->elements[i]); }\n")
 		// }
-		fmt.Fprintf(w, "          free(%[1]s.value); // %[2]s\n", gen.Reg(reg), kind)
+		if kind.Family == FamilyFunction {
+			fmt.Fprintf(w, "          unique_effect_function_free(%[1]s.value); // %[2]s\n", gen.Reg(reg), kind)
+		} else {
+			fmt.Fprintf(w, "          free(%[1]s.value); // %[2]s\n", gen.Reg(reg), kind)
+		}
 		fmt.Fprintf(w, "        }\n")
 	}
 }
@@ -86,18 +103,31 @@ type genCallSyncFunction struct {
 }
 
 func (g *genCallSyncFunction) Generate(gen *generator) string {
+	// Other workers can carry on while a native function runs. The caller
+	// may still be handing arguments to this state, so they're copied out
+	// first, and the results are only stored once the lock is held again.
+	var result strings.Builder
+	result.WriteString("    {\n")
 	cArgs := []string{"rt"}
-	for _, arg := range g.Args {
-		cArgs = append(cArgs, fmt.Sprintf("%s.value", gen.Reg(arg)))
+	for i, arg := range g.Args {
+		fmt.Fprintf(&result, "      val_t arg%d = %s.value;\n", i, gen.Reg(arg))
+		cArgs = append(cArgs, fmt.Sprintf("arg%d", i))
 	}
-	for _, ret := range g.Result {
-		cArgs = append(cArgs, fmt.Sprintf("&%s.value", gen.Reg(ret)))
+	for i := range g.Result {
+		fmt.Fprintf(&result, "      val_t result%d;\n", i)
+		cArgs = append(cArgs, fmt.Sprintf("&result%d", i))
 	}
-	result := fmt.Sprintf("    unique_effect_%s(%s);\n", g.Name, strings.Join(cArgs, ", "))
-	for _, ret := range g.Result {
-		result += fmt.Sprintf("    %s.ready = true;\n", gen.Reg(ret))
+	result.WriteString("      unique_effect_runtime_release(rt);\n")
+	fmt.Fprintf(&result, "      UNIQUE_EFFECT_TRACE(rt, 'B', \"native\", \"%s\", NULL);\n", g.Name)
+	fmt.Fprintf(&result, "      unique_effect_%s(%s);\n", g.Name, strings.Join(cArgs, ", "))
+	fmt.Fprintf(&result, "      UNIQUE_EFFECT_TRACE(rt, 'E', \"native\", \"%s\", NULL);\n", g.Name)
+	result.WriteString("      unique_effect_runtime_acquire(rt);\n")
+	for i, ret := range g.Result {
+		fmt.Fprintf(&result, "      %s.value = result%d;\n", gen.Reg(ret), i)
+		fmt.Fprintf(&result, "      %s.ready = true;\n", gen.Reg(ret))
 	}
-	return result
+	result.WriteString("    }\n")
+	return result.String()
 }
 
 func (g *genCallSyncFunction) Deps() ([]register, []register) {
@@ -112,26 +142,34 @@ type genCallAsyncFunction struct {
 }
 
 func (g *genCallAsyncFunction) Generate(gen *generator) string {
+	// Once the callee has all of its arguments, leave it alone: a loop hands
+	// over to its next iteration and frees itself before returning.
 	var result strings.Builder
-	fmt.Fprintf(&result, "    if (sp->call_%d == NULL) {\n", g.ChildCall)
-	fmt.Fprintf(&result, "      sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
+	fmt.Fprintf(&result, "    if (!sp->call_%d_done) {\n", g.ChildCall)
+	fmt.Fprintf(&result, "      if (sp->call_%d == NULL) {\n", g.ChildCall)
+	fmt.Fprintf(&result, "        sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
 		g.ChildCall, g.Name)
+	fmt.Fprintf(&result, "        UNIQUE_EFFECT_TRACE(rt, 'b', \"call\", \"%s\", sp->call_%d);\n", g.Name, g.ChildCall)
 
 	for i, ret := range g.Result {
-		fmt.Fprintf(&result, "      sp->call_%d->result[%d] = &%s;\n", g.ChildCall, i, gen.Reg(ret))
+		fmt.Fprintf(&result, "        sp->call_%d->result[%d] = &%s;\n", g.ChildCall, i, gen.Reg(ret))
 	}
 
-	fmt.Fprintf(&result, "      sp->call_%d->caller.func = &unique_effect_%s;\n", g.ChildCall, gen.Name)
-	fmt.Fprintf(&result, "      sp->call_%d->caller.state = sp;\n", g.ChildCall)
-	fmt.Fprintf(&result, "      sp->call_%d->conditions[0] = false;\n", g.ChildCall)
-	fmt.Fprintf(&result, "    }\n")
+	fmt.Fprintf(&result, "        sp->call_%d->caller.func = &unique_effect_%s;\n", g.ChildCall, gen.Name)
+	fmt.Fprintf(&result, "        sp->call_%d->caller.state = sp;\n", g.ChildCall)
+	fmt.Fprintf(&result, "        sp->call_%d->conditions[0] = false;\n", g.ChildCall)
+	fmt.Fprintf(&result, "      }\n")
 
+	ready := []string{"true"}
 	for i, arg := range g.Args {
-		fmt.Fprintf(&result, "    sp->call_%d->r[%d].value = %s.value;\n", g.ChildCall, i, gen.Reg(arg))
-		fmt.Fprintf(&result, "    sp->call_%d->r[%d].ready = %s.ready;\n", g.ChildCall, i, gen.Reg(arg))
-		fmt.Fprintf(&result, "    %s.cancelled = sp->call_%d->r[%d].cancelled;\n", gen.Reg(arg), g.ChildCall, i)
+		fmt.Fprintf(&result, "      sp->call_%d->r[%d].value = %s.value;\n", g.ChildCall, i, gen.Reg(arg))
+		fmt.Fprintf(&result, "      sp->call_%d->r[%d].ready = %s.ready;\n", g.ChildCall, i, gen.Reg(arg))
+		fmt.Fprintf(&result, "      %s.cancelled = sp->call_%d->r[%d].cancelled;\n", gen.Reg(arg), g.ChildCall, i)
+		ready = append(ready, fmt.Sprintf("%s.ready", gen.Reg(arg)))
 	}
-	fmt.Fprintf(&result, "    unique_effect_runtime_schedule(rt, (closure_t){.state = sp->call_%d, .func = &unique_effect_%s});\n", g.ChildCall, g.Name)
+	fmt.Fprintf(&result, "      sp->call_%d_done = %s;\n", g.ChildCall, strings.Join(ready, " && "))
+	fmt.Fprintf(&result, "      unique_effect_runtime_schedule(rt, (closure_t){.state = sp->call_%d, .func = &unique_effect_%s});\n", g.ChildCall, g.Name)
+	fmt.Fprintf(&result, "    }\n")
 
 	return result.String()
 }
@@ -141,7 +179,18 @@ func (g *genCallAsyncFunction) Deps() ([]register, []register) {
 	return nil, g.Result
 }
 
+func (g *genCallAsyncFunction) Inputs() []register {
+	return g.Args
+}
+
 func (g *genCallAsyncFunction) GenerateCancel(gen *generator, w io.Writer) {
+	// The arguments stay cancelled, so only the first time is traced.
+	trace := fmt.Sprintf("UNIQUE_EFFECT_TRACE(rt, 'i', \"cancel\", \"%s\", sp->call_%d);", g.Name, g.ChildCall)
+	if len(g.Args) > 0 {
+		fmt.Fprintf(w, "    if (!%s.cancelled) %s\n", gen.Reg(g.Args[0]), trace)
+	} else {
+		fmt.Fprintf(w, "    %s\n", trace)
+	}
 	for _, arg := range g.Args {
 		fmt.Fprintf(w, "    %s.cancelled = true;\n", gen.Reg(arg))
 	}
@@ -158,8 +207,9 @@ func (g *genRestartLoop) Generate(gen *generator) string {
 	var result strings.Builder
 	fmt.Fprintf(&result, "    if (!sp->call_%d_done) {\n", g.ChildCall)
 	fmt.Fprintf(&result, "      if (sp->call_%d == NULL) {\n", g.ChildCall)
-	fmt.Fprintf(&result, "        sp->call_%d = malloc(sizeof(struct unique_effect_%s_state));\n",
+	fmt.Fprintf(&result, "        sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
 		g.ChildCall, gen.Name)
+	fmt.Fprintf(&result, "        UNIQUE_EFFECT_TRACE(rt, 'b', \"call\", \"%s\", sp->call_%d);\n", gen.Name, g.ChildCall)
 	for i := range gen.ReturnKind {
 		fmt.Fprintf(&result, "        sp->call_%d->result[%d] = sp->result[%d];\n", g.ChildCall, i, i)
 	}
@@ -180,6 +230,7 @@ func (g *genRestartLoop) Generate(gen *generator) string {
 	}
 	fmt.Fprintf(&result, "      if (%s) {\n", strings.Join(cArgs, " && "))
 	fmt.Fprintf(&result, "        sp->call_%d_done = true;\n", g.ChildCall)
+	fmt.Fprintf(&result, "        UNIQUE_EFFECT_TRACE(rt, 'e', \"call\", \"%s\", sp);\n", gen.Name)
 
 	freeGarbage(gen, g.Garbage, &result)
 	fmt.Fprintf(&result, "        free(sp);\n")
@@ -193,6 +244,10 @@ func (g *genRestartLoop) Deps() ([]register, []register) {
 	return nil, nil // g.Args, nil
 }
 
+func (g *genRestartLoop) Inputs() []register {
+	return g.Args
+}
+
 type genComment struct {
 	Message string
 }
@@ -215,6 +270,7 @@ func (g *genReturn) Generate(gen *generator) string {
 	for i, reg := range g.ReturnValue {
 		fmt.Fprintf(&b, "    *sp->result[%d] = %s;\n", i, gen.Reg(reg))
 	}
+	fmt.Fprintf(&b, "    UNIQUE_EFFECT_TRACE(rt, 'e', \"call\", \"%s\", sp);\n", gen.Name)
 	fmt.Fprintf(&b, "    unique_effect_runtime_schedule(rt, sp->caller);\n")
 
 	freeGarbage(gen, g.Garbage, &b)
@@ -249,6 +305,10 @@ func (g *genBranch) Deps() ([]register, []register) {
 	return []register{g.Condition}, nil
 }
 
+func (g *genBranch) Branches() map[condition]string {
+	return map[condition]string{g.IfTrue: "true", g.IfFalse: "false"}
+}
+
 type genIntegerComparison struct {
 	Operation string
 	Left      register
@@ -258,7 +318,7 @@ type genIntegerComparison struct {
 
 func (g *genIntegerComparison) Generate(gen *generator) string {
 	b := strings.Builder{}
-	fmt.Fprintf(&b, "    %s.value = %s.value %s %s.value ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), gen.Reg(g.Left), g.Operation, gen.Reg(g.Right))
+	fmt.Fprintf(&b, "    %s.value = (intptr_t)%s.value %s (intptr_t)%s.value ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), gen.Reg(g.Left), g.Operation, gen.Reg(g.Right))
 	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
 	return b.String()
 }
@@ -267,6 +327,68 @@ func (g *genIntegerComparison) Deps() ([]register, []register) {
 	return []register{g.Left, g.Right}, []register{g.Result}
 }
 
+type genStringComparison struct {
+	Operation string
+	Left      register
+	Right     register
+	Result    register
+}
+
+func (g *genStringComparison) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = strcmp(%s.value, %s.value) %s 0 ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), gen.Reg(g.Left), gen.Reg(g.Right), g.Operation)
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genStringComparison) Deps() ([]register, []register) {
+	return []register{g.Left, g.Right}, []register{g.Result}
+}
+
+// genIntegerArithmetic wraps on overflow. Division and remainder are defined
+// for all inputs by the runtime; see unique_effect_divide in builtins.c.
+type genIntegerArithmetic struct {
+	Operation string
+	Left      register
+	Right     register
+	Result    register
+}
+
+func (g *genIntegerArithmetic) Generate(gen *generator) string {
+	b := strings.Builder{}
+	switch g.Operation {
+	case "/":
+		fmt.Fprintf(&b, "    %s.value = unique_effect_divide(%s.value, %s.value);\n", gen.Reg(g.Result), gen.Reg(g.Left), gen.Reg(g.Right))
+	case "%":
+		fmt.Fprintf(&b, "    %s.value = unique_effect_remainder(%s.value, %s.value);\n", gen.Reg(g.Result), gen.Reg(g.Left), gen.Reg(g.Right))
+	default:
+		// Unsigned arithmetic wraps instead of being undefined on overflow.
+		fmt.Fprintf(&b, "    %s.value = (val_t)((uintptr_t)%s.value %s (uintptr_t)%s.value);\n", gen.Reg(g.Result), gen.Reg(g.Left), g.Operation, gen.Reg(g.Right))
+	}
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genIntegerArithmetic) Deps() ([]register, []register) {
+	return []register{g.Left, g.Right}, []register{g.Result}
+}
+
+type genNot struct {
+	Input  register
+	Result register
+}
+
+func (g *genNot) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = %s.value == 0 ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genNot) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
 type genNewArray struct {
 	Result register
 	Values []register
@@ -288,6 +410,41 @@ func (g *genNewArray) Deps() ([]register, []register) {
 	return g.Values, []register{g.Result}
 }
 
+// genArrayElement reads an element of an array, leaving the array intact.
+// Elements of owned arrays are moved out, so each is read only once.
+type genArrayElement struct {
+	Array  register
+	Index  register
+	Result register
+}
+
+func (g *genArrayElement) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = ((struct unique_effect_array*)%s.value)->elements[(intptr_t)%s.value];\n", gen.Reg(g.Result), gen.Reg(g.Array), gen.Reg(g.Index))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genArrayElement) Deps() ([]register, []register) {
+	return []register{g.Array, g.Index}, []register{g.Result}
+}
+
+type genArrayLength struct {
+	Array  register
+	Result register
+}
+
+func (g *genArrayLength) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = (val_t)(intptr_t)((struct unique_effect_array*)%s.value)->length;\n", gen.Reg(g.Result), gen.Reg(g.Array))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genArrayLength) Deps() ([]register, []register) {
+	return []register{g.Array}, []register{g.Result}
+}
+
 type genMakeTuple struct {
 	Inputs []register
 	Result register
@@ -328,6 +485,26 @@ func (g *genUnpackTuple) Deps() ([]register, []register) {
 	return []register{g.Input}, g.Results
 }
 
+// genTupleField reads one field of a tuple, leaving the tuple intact. This is
+// only safe when the field doesn't need to be deleted, or when the tuple is
+// borrowed.
+type genTupleField struct {
+	Input  register
+	Index  int
+	Result register
+}
+
+func (g *genTupleField) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = ((val_t*)%s.value)[%d];\n", gen.Reg(g.Result), gen.Reg(g.Input), g.Index)
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genTupleField) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
 type genCheckUnionType struct {
 	Input     register
 	KindIndex int
@@ -346,6 +523,26 @@ func (g *genCheckUnionType) Deps() ([]register, []register) {
 	return []register{g.Input}, []register{g.Result}
 }
 
+type genMakeUnion struct {
+	Input     register
+	KindIndex int
+	Result    register
+}
+
+func (g *genMakeUnion) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    val_t* tagged = malloc(sizeof(val_t) * 2);\n")
+	fmt.Fprintf(&b, "    tagged[0] = (val_t)(intptr_t)%d;\n", g.KindIndex)
+	fmt.Fprintf(&b, "    tagged[1] = %s.value;\n", gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.value = tagged;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genMakeUnion) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
 type genExtractUnionValue struct {
 	Input  register
 	Result register
@@ -362,3 +559,108 @@ func (g *genExtractUnionValue) Generate(gen *generator) string {
 func (g *genExtractUnionValue) Deps() ([]register, []register) {
 	return []register{g.Input}, []register{g.Result}
 }
+
+// genMakeFunction makes a function value, holding the values captured by a
+// lambda. Frees names the C function that deletes each captured value, or is
+// empty when the value doesn't need deleting.
+type genMakeFunction struct {
+	Name     string
+	Captured []register
+	Frees    []string
+	Result   register
+}
+
+func (g *genMakeFunction) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    struct unique_effect_function *fn = malloc(sizeof(struct unique_effect_function) + sizeof(struct unique_effect_capture) * %d);\n", len(g.Captured))
+	fmt.Fprintf(&b, "    fn->start = &unique_effect_%s_start;\n", g.Name)
+	fmt.Fprintf(&b, "    fn->count = %d;\n", len(g.Captured))
+	for i, reg := range g.Captured {
+		free := "NULL"
+		if g.Frees[i] != "" {
+			free = "&" + g.Frees[i]
+		}
+		fmt.Fprintf(&b, "    fn->captured[%d] = (struct unique_effect_capture){.value = %s.value, .free = %s};\n", i, gen.Reg(reg), free)
+	}
+	fmt.Fprintf(&b, "    %s.value = fn;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genMakeFunction) Deps() ([]register, []register) {
+	return g.Captured, []register{g.Result}
+}
+
+// genCallFunctionValue calls a function value once all of its arguments are
+// ready. Unlike named functions, the callee isn't known until run time, so it
+// is started through the function value.
+type genCallFunctionValue struct {
+	Function  register
+	Args      []register
+	Result    []register
+	ChildCall childCall
+}
+
+func (g *genCallFunctionValue) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    if (!sp->call_%d_done) {\n", g.ChildCall)
+	fmt.Fprintf(&b, "      sp->call_%d_done = true;\n", g.ChildCall)
+	fmt.Fprintf(&b, "      struct unique_effect_function *fn = %s.value;\n", gen.Reg(g.Function))
+
+	args := []string{}
+	for _, arg := range g.Args {
+		args = append(args, fmt.Sprintf("%s.value", gen.Reg(arg)))
+	}
+	results := []string{}
+	for _, ret := range g.Result {
+		results = append(results, fmt.Sprintf("&%s", gen.Reg(ret)))
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(&b, "      val_t *args = NULL;\n")
+	} else {
+		fmt.Fprintf(&b, "      val_t args[] = {%s};\n", strings.Join(args, ", "))
+	}
+	fmt.Fprintf(&b, "      future_t *results[] = {%s};\n", strings.Join(results, ", "))
+	fmt.Fprintf(&b, "      fn->start(rt, fn, args, results, (closure_t){.state = sp, .func = &unique_effect_%s});\n", gen.Name)
+	fmt.Fprintf(&b, "    }\n")
+	return b.String()
+}
+
+func (g *genCallFunctionValue) Deps() ([]register, []register) {
+	return append([]register{g.Function}, g.Args...), g.Result
+}
+
+// genKeepAlive moves a value into a new register once some other registers
+// are ready, so that it isn't deleted while a call is still using it.
+type genKeepAlive struct {
+	Value  register
+	Until  []register
+	Result register
+}
+
+func (g *genKeepAlive) Generate(gen *generator) string {
+	return fmt.Sprintf("    %s = %s;\n", gen.Reg(g.Result), gen.Reg(g.Value))
+}
+
+func (g *genKeepAlive) Deps() ([]register, []register) {
+	return append([]register{g.Value}, g.Until...), []register{g.Result}
+}
+
+// genDelete frees a value once it is ready. Result is only set to show that
+// it has been done, so that it isn't done again.
+type genDelete struct {
+	Value  register
+	Kind   *Kind
+	Result register
+}
+
+func (g *genDelete) Generate(gen *generator) string {
+	b := strings.Builder{}
+	freeGarbage(gen, map[register]*Kind{g.Value: g.Kind}, &b)
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genDelete) Deps() ([]register, []register) {
+	return []register{g.Value}, []register{g.Result}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed gen/builtins.c
+var builtinsSource string
+
+//go:embed gen/builtins.h
+var builtinsHeader string
+
+//go:embed gen/feature_detect.c
+var featureDetectSource string
+
+// A Toolchain compiles generated C code, along with the runtime, into an
+// executable.
+type Toolchain struct {
+	Compiler string
+	Flags    []string
+
+	// Threads builds programs that run on a pool of worker threads, rather
+	// than libuv's event loop.
+	Threads bool
+
+	// VirtualClock builds programs whose sleeps finish instantly, even with
+	// libuv, by jumping the clock to the next timer when there's nothing else
+	// to do.
+	VirtualClock bool
+
+	// Trace builds programs that record when each call, native function,
+	// timer and cancellation happens, and write it out in Chrome's trace
+	// event format when they finish.
+	Trace bool
+
+	// Sanitizers lists the compiler's runtime checks to build programs with,
+	// such as "address" or "thread".
+	Sanitizers []string
+}
+
+// FindToolchain looks for a C compiler (either $CC, clang, or gcc), and checks
+// which optional features of the runtime it can support.
+func FindToolchain() (*Toolchain, error) {
+	candidates := []string{"clang", "gcc"}
+	if cc := os.Getenv("CC"); cc != "" {
+		candidates = append([]string{cc}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		path, err := exec.LookPath(candidate)
+		if err != nil {
+			continue
+		}
+
+		t := &Toolchain{Compiler: path}
+		if err := t.detectFeatures(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("no C compiler found (tried %s)", strings.Join(candidates, ", "))
+}
+
+// detectFeatures enables libuv if a test program can be linked against it.
+func (t *Toolchain) detectFeatures() error {
+	features := []string{"-DUSE_LIBUV", "-luv"}
+	ok, err := t.Supports(features...)
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.Flags = append(t.Flags, features...)
+	}
+	return nil
+}
+
+// Supports reports whether a test program can be compiled and linked with
+// the given flags.
+func (t *Toolchain) Supports(flags ...string) (bool, error) {
+	dir, err := ioutil.TempDir("", "unique_effect")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "feature_detect.c")
+	if err := ioutil.WriteFile(source, []byte(featureDetectSource), 0666); err != nil {
+		return false, err
+	}
+
+	args := append([]string{"-o", filepath.Join(dir, "detect"), source}, flags...)
+	return exec.Command(t.Compiler, args...).Run() == nil, nil
+}
+
+// Build compiles the output of Parse for the given module into an executable
+// at the given path.
+func (t *Toolchain) Build(sources map[string]string, module string, output string) error {
+	dir, err := ioutil.TempDir("", "unique_effect")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"builtins.c": builtinsSource,
+		"builtins.h": builtinsHeader,
+	}
+	for name, contents := range sources {
+		files[name] = contents
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"-o", output, "-I", dir,
+		filepath.Join(dir, "builtins.c"), filepath.Join(dir, module+".c")}
+	if t.Threads {
+		// libuv isn't thread safe, so it's left out.
+		args = append(args, "-DUSE_THREADS", "-pthread")
+	} else {
+		args = append(args, t.Flags...)
+	}
+	if t.VirtualClock {
+		args = append(args, "-DUSE_VIRTUAL_CLOCK")
+	}
+	if t.Trace {
+		args = append(args, "-DUSE_TRACE")
+	}
+	if len(t.Sanitizers) > 0 {
+		args = append(args, "-g", "-fsanitize="+strings.Join(t.Sanitizers, ","))
+	}
+
+	cmd := exec.Command(t.Compiler, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", filepath.Base(t.Compiler), err)
+	}
+	return nil
+}
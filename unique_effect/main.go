@@ -15,48 +15,312 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/fatlotus/unique_effect"
 )
 
-func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s [module name]\n", os.Args[0])
-		os.Exit(1)
+// searchPathFlag collects repeated -I flags.
+type searchPathFlag []string
+
+func (s *searchPathFlag) String() string {
+	return strings.Join(*s, ":")
+}
+
+func (s *searchPathFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// errorFormat is how compile errors are printed: "human" for source snippets,
+// or "json" for one JSON object per line.
+var errorFormat = "human"
+
+func addErrorFormatFlag(flags *flag.FlagSet) {
+	flags.StringVar(&errorFormat, "error-format", errorFormat, "how to print compile errors (human or json)")
+}
+
+// reportError prints err, which may list several diagnostics, in the format
+// chosen on the command line. Like the program's own errors, they go to
+// stderr, so that they don't mix with what a program run with "run" prints.
+func reportError(err error) {
+	var diags unique_effect.Diagnostics
+	if !errors.As(err, &diags) {
+		diags = unique_effect.Diagnostics{{Severity: unique_effect.SeverityError, Message: err.Error()}}
 	}
 
-	files, err := ioutil.ReadDir("examples/")
-	if err != nil {
-		fmt.Printf("Failed to read test dir: %v\n", err)
-		os.Exit(1)
+	if errorFormat == "json" {
+		encoder := json.NewEncoder(os.Stderr)
+		for _, diag := range diags {
+			_ = encoder.Encode(diag)
+		}
 		return
 	}
 
-	sources := map[string]string{}
-	for _, file := range files {
-		contents, err := ioutil.ReadFile("examples/" + file.Name())
+	for _, diag := range diags {
+		diag.Render(os.Stderr, ioutil.ReadFile)
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// searchPath finds the module named by arg (either a path to a .ht file or a
+// bare module name), and where to look for it and its imports.
+func searchPath(arg string, includes []string) (string, unique_effect.SearchPath) {
+	module, dir := unique_effect.ModuleForPath(arg)
+
+	// Files named on the command line take precedence over the search path,
+	// so that they can import their siblings.
+	search := unique_effect.SearchPath{}
+	if dir != "" {
+		search = append(search, dir)
+	}
+	search = append(search, includes...)
+	if len(search) == 0 {
+		search = append(search, ".")
+	}
+	return module, search
+}
+
+// compile parses the module named by arg, returning the module name and the
+// generated sources.
+func compile(arg string, includes []string) (string, map[string]string, error) {
+	module, search := searchPath(arg, includes)
+	result, err := unique_effect.Parse(module, search)
+	return module, result, err
+}
+
+func generate(args []string) error {
+	var includes searchPathFlag
+
+	flags := flag.NewFlagSet("unique_effect", flag.ExitOnError)
+	outputDir := flags.String("o", ".", "directory to write generated sources into")
+	flags.Var(&includes, "I", "directory to search for imported modules (may be repeated)")
+	addErrorFormatFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: unique_effect [-o dir] [-I dir]... [--error-format=human|json] [file.ht or module name]...\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	for _, arg := range flags.Args() {
+		_, result, err := compile(arg, includes)
 		if err != nil {
-			fmt.Printf("Failed to read file: %v\n", err)
-			os.Exit(1)
-			return
+			return err
 		}
-		sources[file.Name()] = string(contents)
-	}
 
-	result, err := unique_effect.Parse(os.Args[1], sources)
-	if err == nil {
 		for name, contents := range result {
-			err := ioutil.WriteFile(fmt.Sprintf("gen/sources/%s", name), []byte(contents), 0777)
+			err := ioutil.WriteFile(filepath.Join(*outputDir, name), []byte(contents), 0666)
 			if err != nil {
-				fmt.Printf("failed to write file: %s\n", err)
-				os.Exit(1)
+				return fmt.Errorf("failed to write file: %w", err)
 			}
 		}
-	} else {
-		fmt.Printf("Error: %v\n", err)
+	}
+	return nil
+}
+
+func build(args []string) error {
+	var includes searchPathFlag
+
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	output := flags.String("o", "", "path of the executable to write (defaults to the module name)")
+	threads := flags.Bool("threads", false, "run the program on a pool of threads instead of libuv")
+	virtualClock := flags.Bool("virtual-clock", false, "finish sleeps instantly, instead of waiting in real time")
+	trace := flags.Bool("trace", false, "write a Chrome trace of the program to $UNIQUE_EFFECT_TRACE (or trace.json) when it finishes")
+	flags.Var(&includes, "I", "directory to search for imported modules (may be repeated)")
+	addErrorFormatFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: unique_effect build [-o executable] [-threads] [-virtual-clock] [-trace] [-I dir]... [--error-format=human|json] [file.ht or module name]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	module, result, err := compile(flags.Arg(0), includes)
+	if err != nil {
+		return err
+	}
+
+	toolchain, err := unique_effect.FindToolchain()
+	if err != nil {
+		return err
+	}
+	toolchain.Threads = *threads
+	toolchain.VirtualClock = *virtualClock
+	toolchain.Trace = *trace
+
+	if *output == "" {
+		*output = module
+	}
+	return toolchain.Build(result, module, *output)
+}
+
+func run(args []string) error {
+	var includes searchPathFlag
+
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	interpret := flags.Bool("interpret", false, "run with the built-in interpreter instead of a C compiler")
+	threads := flags.Bool("threads", false, "run the program on a pool of threads instead of libuv")
+	virtualClock := flags.Bool("virtual-clock", false, "finish sleeps instantly, instead of waiting in real time")
+	trace := flags.Bool("trace", false, "write a Chrome trace of the program to $UNIQUE_EFFECT_TRACE (or trace.json) when it finishes")
+	flags.Var(&includes, "I", "directory to search for imported modules (may be repeated)")
+	addErrorFormatFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: unique_effect run [-interpret] [-threads] [-virtual-clock] [-trace] [-I dir]... [--error-format=human|json] [file.ht or module name] [args]...\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	if *interpret {
+		module, search := searchPath(flags.Arg(0), includes)
+		return unique_effect.Interpret(module, search, flags.Args()[1:], os.Stdin, os.Stdout, os.Stderr)
+	}
+
+	module, result, err := compile(flags.Arg(0), includes)
+	if err != nil {
+		return err
+	}
+
+	toolchain, err := unique_effect.FindToolchain()
+	if err != nil {
+		return err
+	}
+	toolchain.Threads = *threads
+	toolchain.VirtualClock = *virtualClock
+	toolchain.Trace = *trace
+
+	dir, err := ioutil.TempDir("", "unique_effect")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	executable := filepath.Join(dir, module)
+	if err := toolchain.Build(result, module, executable); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, flags.Args()[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The program's exit status is passed through, as when it's interpreted.
+	var exit *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exit) {
+		return &unique_effect.ExitError{Code: exit.ExitCode()}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func graph(args []string) error {
+	var includes searchPathFlag
+
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	output := flags.String("o", "", "path of the DOT file to write (defaults to standard output)")
+	flags.Var(&includes, "I", "directory to search for imported modules (may be repeated)")
+	addErrorFormatFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: unique_effect graph [-o file.dot] [-I dir]... [--error-format=human|json] [file.ht or module name]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	module, search := searchPath(flags.Arg(0), includes)
+	dot, err := unique_effect.Graph(module, search)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		fmt.Print(dot)
+		return nil
+	}
+	if err := ioutil.WriteFile(*output, []byte(dot), 0666); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+func analyze(args []string) error {
+	var includes searchPathFlag
+
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	flags.Var(&includes, "I", "directory to search for imported modules (may be repeated)")
+	addErrorFormatFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: unique_effect analyze [-I dir]... [--error-format=human|json] [file.ht or module name]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	module, search := searchPath(flags.Arg(0), includes)
+	report, err := unique_effect.Analyze(module, search)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
+
+func main() {
+	command, args := generate, os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "build":
+			command, args = build, args[1:]
+		case "run":
+			command, args = run, args[1:]
+		case "graph":
+			command, args = graph, args[1:]
+		case "analyze":
+			command, args = analyze, args[1:]
+		}
+	}
+
+	if err := command(args); err != nil {
+		var failed *unique_effect.ExitError
+		if errors.As(err, &failed) {
+			if failed.Reason != "" {
+				fmt.Fprintf(os.Stderr, "error: %s\n", failed.Reason)
+			}
+			os.Exit(failed.Code)
+		}
+
+		reportError(err)
 		os.Exit(1)
 	}
 }